@@ -0,0 +1,322 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/metrictank/schema"
+	"github.com/raintank/raintank-probe/checks"
+	"github.com/raintank/raintank-probe/probe"
+	"github.com/raintank/raintank-probe/scheduler"
+	"github.com/raintank/raintank-probe/standalone"
+	m "github.com/raintank/worldping-api/pkg/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// maximum size of a request body.
+const maxBodySize = 1 << 20
+
+type Api struct {
+	server       *http.Server
+	jobScheduler *scheduler.Scheduler
+	token        string
+}
+
+// NewApi runs a HTTP server for managing the checks running on this probe.
+// All requests must include the token as a bearer token in the Authorization header.
+func NewApi(jobScheduler *scheduler.Scheduler, addr string, token string) *Api {
+	a := Api{
+		jobScheduler: jobScheduler,
+		token:        token,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/checks", a.auth(a.ChecksHandler()))
+	mux.HandleFunc("/api/checks/", a.auth(a.CheckHandler()))
+	mux.HandleFunc("/api/adhoc", a.auth(a.AdhocHandler()))
+	// there is no WriteTimeout, as running a check can take longer than any
+	// fixed timeout. execute sets a deadline based on the check instead.
+	s := &http.Server{
+		Addr:        addr,
+		Handler:     mux,
+		ReadTimeout: 10 * time.Second,
+		IdleTimeout: 60 * time.Second,
+	}
+	a.server = s
+	go func() {
+		err := s.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorf("api server error. %s", err)
+		}
+	}()
+	return &a
+}
+
+func (a *Api) Stop() {
+	a.server.Close()
+	log.Info("api server closed")
+}
+
+func (a *Api) auth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			writeError(w, http.StatusUnauthorized, "missing bearer token")
+			return
+		}
+		token := strings.TrimPrefix(header, "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "invalid api token")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+		next(w, r)
+	}
+}
+
+// ChecksHandler handles requests to /api/checks
+//
+//	GET  - list all checks and their current state.
+//	POST - create a new check.
+func (a *Api) ChecksHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJson(w, http.StatusOK, a.jobScheduler.List())
+		case http.MethodPost:
+			check, err := readCheck(r, 0)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if _, ok := a.jobScheduler.Get(check.Id); ok {
+				writeError(w, http.StatusConflict, "check already exists")
+				return
+			}
+			if err := a.jobScheduler.Create(check); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			a.writeStatus(w, http.StatusCreated, check.Id)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
+
+// CheckHandler handles requests to /api/checks/:id
+//
+//	GET    - get the check and its current state.
+//	PUT    - update the check.
+//	DELETE - remove the check.
+//
+// and POST requests to /api/checks/:id/run, which execute the check immediately.
+func (a *Api) CheckHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/checks/"), "/")
+		id, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || len(parts) > 2 || (len(parts) == 2 && parts[1] != "run") {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		status, ok := a.jobScheduler.Get(id)
+		if !ok {
+			writeError(w, http.StatusNotFound, scheduler.ErrCheckNotFound.Error())
+			return
+		}
+		if len(parts) == 2 {
+			if r.Method != http.MethodPost {
+				writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+			execute(w, status.Check)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeJson(w, http.StatusOK, status)
+		case http.MethodPut:
+			check, err := readCheck(r, id)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if !check.Enabled {
+				a.jobScheduler.Remove(check)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			if err := a.jobScheduler.Update(check); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			a.writeStatus(w, http.StatusOK, id)
+		case http.MethodDelete:
+			if err := a.jobScheduler.Remove(status.Check); err != nil {
+				writeError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
+
+type adhocRequest struct {
+	Type      m.CheckType            `json:"type"`
+	Settings  map[string]interface{} `json:"settings"`
+	Slug      string                 `json:"endpointSlug"`
+	Frequency int64                  `json:"frequency"`
+}
+
+// AdhocHandler handles POST requests to /api/adhoc, which run a check
+// built from the passed type and settings once.
+func (a *Api) AdhocHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		req := adhocRequest{}
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if req.Slug == "" {
+			req.Slug = "adhoc"
+		}
+		if req.Frequency <= 0 {
+			req.Frequency = 60
+		}
+		if req.Settings == nil {
+			req.Settings = make(map[string]interface{})
+		}
+		check := &m.CheckWithSlug{
+			Check: m.Check{
+				Type:      req.Type,
+				Frequency: req.Frequency,
+				Enabled:   true,
+				Settings:  req.Settings,
+			},
+			Slug: req.Slug,
+		}
+		if probe.Self != nil {
+			check.OrgId = probe.Self.OrgId
+		}
+		if _, err := scheduler.GetCheck(check.Type, check.Settings); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		execute(w, check)
+	}
+}
+
+type executeResponse struct {
+	Result   checks.CheckResult   `json:"result"`
+	Error    string               `json:"error"`
+	Warning  string               `json:"warning"`
+	Duration float64              `json:"duration"`
+	Metrics  []*schema.MetricData `json:"metrics"`
+}
+
+type executeResult struct {
+	result  checks.CheckResult
+	metrics []*schema.MetricData
+	err     error
+}
+
+// executeDeadline returns how long a run of the check can take. Retries are
+// only started while they can complete before the next scheduled run, so a
+// run takes at most the check frequency plus the timeout of the last attempt.
+func executeDeadline(check *m.CheckWithSlug) time.Duration {
+	timeout := 5.0
+	if t, ok := check.Settings["timeout"].(float64); ok && t > 0 {
+		timeout = t
+	}
+	return time.Duration(check.Frequency)*time.Second + time.Duration(timeout*float64(time.Second)) + 5*time.Second
+}
+
+// execute runs the check once and writes the result. Nothing is published.
+func execute(w http.ResponseWriter, check *m.CheckWithSlug) {
+	start := time.Now()
+	done := make(chan executeResult, 1)
+	go func() {
+		result, metrics, err := scheduler.Execute(check, start)
+		done <- executeResult{result, metrics, err}
+	}()
+	var res executeResult
+	select {
+	case res = <-done:
+	case <-time.After(executeDeadline(check)):
+		writeError(w, http.StatusGatewayTimeout, "check did not complete in time")
+		return
+	}
+	result, metrics, err := res.result, res.metrics, res.err
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJson(w, http.StatusOK, executeResponse{
+		Result:   result,
+		Error:    result.ErrorMsg(),
+		Warning:  scheduler.Warning(check, result),
+		Duration: time.Since(start).Seconds() * 1000,
+		Metrics:  metrics,
+	})
+}
+
+func (a *Api) writeStatus(w http.ResponseWriter, code int, id int64) {
+	status, ok := a.jobScheduler.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, scheduler.ErrCheckNotFound.Error())
+		return
+	}
+	writeJson(w, code, status)
+}
+
+// readCheck decodes a check definition from the request body. If id is
+// non-zero it overrides any id in the body. The orgId defaults to the org of
+// the probe, so it must be passed until the probe identity is known.
+func readCheck(r *http.Request, id int64) (*m.CheckWithSlug, error) {
+	def := standalone.CheckDefinition{}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&def); err != nil {
+		return nil, err
+	}
+	if id != 0 {
+		def.Id = id
+	}
+	var orgId int64
+	if probe.Self != nil {
+		orgId = probe.Self.OrgId
+	}
+	check, err := def.ToCheck(orgId, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if check.OrgId <= 0 {
+		return nil, fmt.Errorf("orgId must be set")
+	}
+	return check, nil
+}
+
+func writeJson(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Errorf("api: unable to encode response. %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJson(w, code, map[string]string{"error": msg})
+}
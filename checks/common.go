@@ -14,31 +14,40 @@ type CheckResult interface {
 	ErrorMsg() string
 }
 
-func ResolveHost(host, ipversion string) (string, error) {
+// ResolveHost returns the address of host that checks should connect to. Only
+// addresses permitted by the policy are returned. A nil policy means the
+// GlobalPolicy. The policy's rate limit is not applied, callers must Take a
+// token for the address just before connecting to it.
+func ResolveHost(host, ipversion string, policy *DestinationPolicy) (string, error) {
+	policy = policy.orGlobal()
 	addrs, err := net.LookupIP(host)
 	if err != nil || len(addrs) < 1 {
 		return "", fmt.Errorf("failed to resolve hostname to IP.")
 	}
 
+	var policyErr error
 	for _, addr := range addrs {
 		// only allow Global unicast, or loopback addresses
 		// to be used.
 		if !(addr.IsGlobalUnicast() || addr.IsLoopback()) {
 			continue
 		}
-		if ipversion == "any" {
-			return addr.String(), nil
-		}
-
-		if !isIPv4(addr) {
-			if ipversion == "v6" {
-				return addr.String(), nil
+		if ipversion != "any" {
+			if !isIPv4(addr) && ipversion != "v6" {
+				continue
 			}
-		} else {
-			if ipversion == "v4" {
-				return addr.String(), nil
+			if isIPv4(addr) && ipversion != "v4" {
+				continue
 			}
 		}
+		if err := policy.Permitted(addr); err != nil {
+			policyErr = err
+			continue
+		}
+		return addr.String(), nil
+	}
+	if policyErr != nil {
+		return "", policyErr
 	}
 
 	return "", fmt.Errorf("failed to resolve hostname to valid IP.")
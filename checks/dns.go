@@ -112,6 +112,8 @@ type RaintankProbeDns struct {
 	Protocol    string
 	Timeout     time.Duration
 	ExpectRegex string
+	// destinations the check can connect to. nil means the GlobalPolicy.
+	Policy *DestinationPolicy
 }
 
 func NewRaintankDnsProbe(settings map[string]interface{}) (*RaintankProbeDns, error) {
@@ -229,6 +231,8 @@ func (p *RaintankProbeDns) Run() (CheckResult, error) {
 	}
 	m.SetQuestion(p.RecordName, recordTypeToWireType[p.RecordType])
 
+	var policyErr error
+
 	for _, s := range p.Servers {
 		if time.Now().After(deadline) {
 			msg := "timeout looking up dns record."
@@ -237,8 +241,23 @@ func (p *RaintankProbeDns) Run() (CheckResult, error) {
 		}
 		//trim any leading/training whitespace.
 		server := strings.Trim(s, " ")
+		// resolve the server ourselves, so the probe's policy is applied to
+		// the address that is queried.
+		serverAddr, err := ResolveHost(server, "any", p.Policy)
+		if err != nil {
+			if _, ok := err.(*PolicyError); ok {
+				policyErr = err
+			}
+			//try the next server.
+			continue
+		}
+		// only take a token for the server that is about to be queried.
+		if err := p.Policy.Take(serverAddr); err != nil {
+			policyErr = err
+			continue
+		}
 
-		srvPort := net.JoinHostPort(server, strconv.FormatInt(p.Port, 10))
+		srvPort := net.JoinHostPort(serverAddr, strconv.FormatInt(p.Port, 10))
 		start := time.Now()
 		r, t, err := c.Exchange(&m, srvPort)
 		if err != nil || r == nil {
@@ -302,6 +321,9 @@ func (p *RaintankProbeDns) Run() (CheckResult, error) {
 		return result, nil
 	}
 	msg := "All target servers failed to respond"
+	if policyErr != nil {
+		msg = fmt.Sprintf("%s. %s", msg, policyErr)
+	}
 	result.Error = &msg
 	return result, nil
 }
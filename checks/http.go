@@ -176,6 +176,8 @@ type RaintankProbeHTTP struct {
 	Timeout       time.Duration `json:"timeout"`
 	DownloadLimit int64         `json:"downloadLimit"`
 	IPVersion     string        `json:"ipversion"`
+	// destinations the check can connect to. nil means the GlobalPolicy.
+	Policy *DestinationPolicy `json:"-"`
 }
 
 // NewRaintankHTTPProbe json check
@@ -376,7 +378,7 @@ func (p *RaintankProbeHTTP) Run() (CheckResult, error) {
 	// DNS lookup
 	step := time.Now()
 
-	ipAddr, err := ResolveHost(p.Host, p.IPVersion)
+	ipAddr, err := ResolveHost(p.Host, p.IPVersion, p.Policy)
 	if err != nil {
 		msg := fmt.Sprintf("error resolving hostname. %s", err.Error())
 		result.Error = &msg
@@ -387,6 +389,11 @@ func (p *RaintankProbeHTTP) Run() (CheckResult, error) {
 		result.Error = &msg
 		return result, nil
 	}
+	if err := p.Policy.Take(ipAddr); err != nil {
+		msg := err.Error()
+		result.Error = &msg
+		return result, nil
+	}
 
 	dnsResolve := time.Since(step).Seconds() * 1000
 	result.DNS = &dnsResolve
@@ -140,6 +140,8 @@ type RaintankProbePing struct {
 	Hostname  string        `json:"hostname"`
 	Timeout   time.Duration `json:"timeout"`
 	IPVersion string        `json:"ipversion"`
+	// destinations the check can connect to. nil means the GlobalPolicy.
+	Policy *DestinationPolicy `json:"-"`
 }
 
 // parse the json request body to build our check definition.
@@ -193,7 +195,7 @@ func (p *RaintankProbePing) Run() (CheckResult, error) {
 	result := &PingResult{}
 
 	// get IP from hostname.
-	ipAddr, err := ResolveHost(p.Hostname, p.IPVersion)
+	ipAddr, err := ResolveHost(p.Hostname, p.IPVersion, p.Policy)
 	if err != nil {
 		msg := err.Error()
 		result.Error = &msg
@@ -204,6 +206,11 @@ func (p *RaintankProbePing) Run() (CheckResult, error) {
 		result.Error = &msg
 		return result, nil
 	}
+	if err := p.Policy.Take(ipAddr); err != nil {
+		msg := err.Error()
+		result.Error = &msg
+		return result, nil
+	}
 
 	// fmt.Printf("pinging %#v\n", ipAddr)
 	results, err := GlobalPinger.Ping(net.ParseIP(ipAddr), count, p.Timeout)
@@ -0,0 +1,195 @@
+package checks
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// address ranges blocked by DestinationPolicy.BlockPrivate, in addition to
+// loopback, link-local and unspecified addresses.
+var privateRanges = mustParseCIDRs(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+	"fc00::/7",
+)
+
+// DestinationPolicy restricts the addresses that checks can connect to. It is
+// applied to the address a check's host resolves to, which is the address the
+// check then connects to. The http and https checks do not follow redirects,
+// so every connection made by a check is covered.
+type DestinationPolicy struct {
+	// if set, only addresses in these ranges are allowed.
+	Allow []*net.IPNet
+	// addresses in these ranges are never allowed.
+	Deny []*net.IPNet
+	// block loopback, private, link-local and unspecified addresses.
+	BlockPrivate bool
+	// maximum number of checks per second to a single address, and the
+	// number that can be made at once. 0 means unlimited.
+	RateLimit float64
+	RateBurst int
+
+	sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// GlobalPolicy is applied to checks that do not set their own Policy. By
+// default every address is allowed.
+var GlobalPolicy = &DestinationPolicy{}
+
+// Unrestricted allows every address, without a rate limit. It is used for
+// destinations set by the operator rather than by users, such as health targets.
+var Unrestricted = &DestinationPolicy{}
+
+// orGlobal returns the GlobalPolicy if p is nil.
+func (p *DestinationPolicy) orGlobal() *DestinationPolicy {
+	if p == nil {
+		return GlobalPolicy
+	}
+	return p
+}
+
+// PolicyError is returned when a check's destination is rejected by the
+// GlobalPolicy.
+type PolicyError struct {
+	IP     net.IP
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("destination %s is not allowed by the probe's policy. %s", e.IP, e.Reason)
+}
+
+// ParseCIDRs parses a comma separated list of CIDR ranges. Single addresses
+// are treated as a range containing only that address.
+func ParseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			bits := 128
+			if isIPv4(ip) {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func mustParseCIDRs(list ...string) []*net.IPNet {
+	nets, err := ParseCIDRs(strings.Join(list, ","))
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+// Permitted returns a PolicyError if the policy does not allow connections to ip.
+func (p *DestinationPolicy) Permitted(ip net.IP) error {
+	if p.BlockPrivate {
+		if ip.IsLoopback() {
+			return &PolicyError{IP: ip, Reason: "loopback addresses are blocked."}
+		}
+		if ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+			return &PolicyError{IP: ip, Reason: "link-local addresses are blocked."}
+		}
+		if ip.IsUnspecified() {
+			return &PolicyError{IP: ip, Reason: "unspecified addresses are blocked."}
+		}
+		if contains(privateRanges, ip) {
+			return &PolicyError{IP: ip, Reason: "private addresses are blocked."}
+		}
+	}
+	if contains(p.Deny, ip) {
+		return &PolicyError{IP: ip, Reason: "address is in a denied range."}
+	}
+	if len(p.Allow) > 0 && !contains(p.Allow, ip) {
+		return &PolicyError{IP: ip, Reason: "address is not in an allowed range."}
+	}
+	return nil
+}
+
+// Take uses up one of the checks allowed to addr by the rate limit. A
+// PolicyError is returned if the limit has been reached. A nil policy means
+// the GlobalPolicy.
+func (p *DestinationPolicy) Take(addr string) error {
+	p = p.orGlobal()
+	if p.RateLimit <= 0 {
+		return nil
+	}
+	burst := float64(p.RateBurst)
+	if burst < 1 {
+		burst = 1
+	}
+	now := time.Now()
+	ip := net.ParseIP(addr)
+	key := ip.String()
+
+	p.Lock()
+	defer p.Unlock()
+	if p.buckets == nil {
+		p.buckets = make(map[string]*tokenBucket)
+	}
+	b, ok := p.buckets[key]
+	if !ok {
+		if len(p.buckets) >= 10000 {
+			p.purge(now, burst)
+		}
+		b = &tokenBucket{tokens: burst, last: now}
+		p.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * p.RateLimit
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return &PolicyError{IP: ip, Reason: fmt.Sprintf("rate limit of %v checks per second to this address exceeded.", p.RateLimit)}
+	}
+	b.tokens--
+	return nil
+}
+
+// purge removes buckets that have refilled, as they are no different from a
+// new bucket. The caller must hold the lock.
+func (p *DestinationPolicy) purge(now time.Time, burst float64) {
+	for key, b := range p.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*p.RateLimit >= burst {
+			delete(p.buckets, key)
+		}
+	}
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
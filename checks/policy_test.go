@@ -0,0 +1,165 @@
+package checks
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    []string
+		wantErr bool
+	}{
+		{list: "", want: nil},
+		{list: " , ", want: nil},
+		{list: "10.0.0.0/8", want: []string{"10.0.0.0/8"}},
+		{list: "10.1.2.3/8", want: []string{"10.0.0.0/8"}},
+		{list: "192.0.2.1", want: []string{"192.0.2.1/32"}},
+		{list: "2001:db8::1", want: []string{"2001:db8::1/128"}},
+		{list: " 10.0.0.0/8 , 2001:db8::/32 ", want: []string{"10.0.0.0/8", "2001:db8::/32"}},
+		{list: "10.0.0.0/33", wantErr: true},
+		{list: "example.com", wantErr: true},
+		{list: "10.0.0.0/8,bogus", wantErr: true},
+	}
+	for _, tt := range tests {
+		nets, err := ParseCIDRs(tt.list)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseCIDRs(%q) expected an error, got %v", tt.list, nets)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseCIDRs(%q) unexpected error. %s", tt.list, err)
+			continue
+		}
+		if len(nets) != len(tt.want) {
+			t.Errorf("ParseCIDRs(%q) = %v, want %v", tt.list, nets, tt.want)
+			continue
+		}
+		for i, n := range nets {
+			if n.String() != tt.want[i] {
+				t.Errorf("ParseCIDRs(%q)[%d] = %s, want %s", tt.list, i, n, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestPermitted(t *testing.T) {
+	allow := mustParseCIDRs("192.0.2.0/24", "2001:db8::/32")
+	deny := mustParseCIDRs("192.0.2.128/25")
+	tests := []struct {
+		name    string
+		policy  *DestinationPolicy
+		ip      string
+		allowed bool
+	}{
+		{"empty policy allows public", &DestinationPolicy{}, "8.8.8.8", true},
+		{"empty policy allows private", &DestinationPolicy{}, "10.0.0.1", true},
+		{"empty policy allows loopback", &DestinationPolicy{}, "127.0.0.1", true},
+		{"block private rejects loopback", &DestinationPolicy{BlockPrivate: true}, "127.0.0.1", false},
+		{"block private rejects ipv6 loopback", &DestinationPolicy{BlockPrivate: true}, "::1", false},
+		{"block private rejects 10/8", &DestinationPolicy{BlockPrivate: true}, "10.1.2.3", false},
+		{"block private rejects 172.16/12", &DestinationPolicy{BlockPrivate: true}, "172.31.255.255", false},
+		{"block private allows 172.32", &DestinationPolicy{BlockPrivate: true}, "172.32.0.1", true},
+		{"block private rejects 192.168/16", &DestinationPolicy{BlockPrivate: true}, "192.168.1.1", false},
+		{"block private rejects cgnat", &DestinationPolicy{BlockPrivate: true}, "100.64.0.1", false},
+		{"block private rejects link-local", &DestinationPolicy{BlockPrivate: true}, "169.254.169.254", false},
+		{"block private rejects ipv6 link-local", &DestinationPolicy{BlockPrivate: true}, "fe80::1", false},
+		{"block private rejects ula", &DestinationPolicy{BlockPrivate: true}, "fd00::1", false},
+		{"block private rejects unspecified", &DestinationPolicy{BlockPrivate: true}, "0.0.0.0", false},
+		{"block private allows public", &DestinationPolicy{BlockPrivate: true}, "8.8.8.8", true},
+		{"deny rejects match", &DestinationPolicy{Deny: deny}, "192.0.2.200", false},
+		{"deny allows others", &DestinationPolicy{Deny: deny}, "192.0.2.1", true},
+		{"allow accepts match", &DestinationPolicy{Allow: allow}, "192.0.2.1", true},
+		{"allow accepts ipv6 match", &DestinationPolicy{Allow: allow}, "2001:db8::1", true},
+		{"allow rejects others", &DestinationPolicy{Allow: allow}, "8.8.8.8", false},
+		{"deny wins over allow", &DestinationPolicy{Allow: allow, Deny: deny}, "192.0.2.200", false},
+		{"block private wins over allow", &DestinationPolicy{Allow: mustParseCIDRs("10.0.0.0/8"), BlockPrivate: true}, "10.0.0.1", false},
+	}
+	for _, tt := range tests {
+		err := tt.policy.Permitted(net.ParseIP(tt.ip))
+		if tt.allowed && err != nil {
+			t.Errorf("%s: %s was rejected. %s", tt.name, tt.ip, err)
+		}
+		if !tt.allowed {
+			if err == nil {
+				t.Errorf("%s: %s was allowed", tt.name, tt.ip)
+			} else if _, ok := err.(*PolicyError); !ok {
+				t.Errorf("%s: expected a PolicyError, got %T", tt.name, err)
+			}
+		}
+	}
+}
+
+func TestTake(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  *DestinationPolicy
+		takes   int
+		allowed int
+	}{
+		{"no limit", &DestinationPolicy{}, 100, 100},
+		{"burst", &DestinationPolicy{RateLimit: 0.001, RateBurst: 5}, 10, 5},
+		{"burst defaults to 1", &DestinationPolicy{RateLimit: 0.001}, 3, 1},
+	}
+	for _, tt := range tests {
+		allowed := 0
+		for i := 0; i < tt.takes; i++ {
+			if err := tt.policy.Take("192.0.2.1"); err == nil {
+				allowed++
+			} else if _, ok := err.(*PolicyError); !ok {
+				t.Errorf("%s: expected a PolicyError, got %T", tt.name, err)
+			}
+		}
+		if allowed != tt.allowed {
+			t.Errorf("%s: %d of %d takes allowed, want %d", tt.name, allowed, tt.takes, tt.allowed)
+		}
+	}
+}
+
+func TestTakePerAddress(t *testing.T) {
+	p := &DestinationPolicy{RateLimit: 0.001, RateBurst: 1}
+	if err := p.Take("192.0.2.1"); err != nil {
+		t.Fatalf("first take for 192.0.2.1 failed. %s", err)
+	}
+	if err := p.Take("192.0.2.1"); err == nil {
+		t.Fatal("second take for 192.0.2.1 was allowed")
+	}
+	if err := p.Take("192.0.2.2"); err != nil {
+		t.Fatalf("take for another address failed. %s", err)
+	}
+}
+
+func TestTakeRefill(t *testing.T) {
+	p := &DestinationPolicy{RateLimit: 100, RateBurst: 1}
+	if err := p.Take("192.0.2.1"); err != nil {
+		t.Fatalf("first take failed. %s", err)
+	}
+	if err := p.Take("192.0.2.1"); err == nil {
+		t.Fatal("take before refill was allowed")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := p.Take("192.0.2.1"); err != nil {
+		t.Fatalf("take after refill failed. %s", err)
+	}
+}
+
+func TestNilPolicyIsGlobal(t *testing.T) {
+	saved := GlobalPolicy
+	defer func() { GlobalPolicy = saved }()
+	GlobalPolicy = &DestinationPolicy{RateLimit: 0.001, RateBurst: 1}
+
+	var p *DestinationPolicy
+	if err := p.Take("192.0.2.1"); err != nil {
+		t.Fatalf("first take failed. %s", err)
+	}
+	if err := p.Take("192.0.2.1"); err == nil {
+		t.Fatal("nil policy did not apply the GlobalPolicy rate limit")
+	}
+	if err := Unrestricted.Take("192.0.2.1"); err != nil {
+		t.Fatalf("Unrestricted applied a rate limit. %s", err)
+	}
+}
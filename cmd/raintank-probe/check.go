@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/raintank/raintank-probe/checks"
+	"github.com/raintank/raintank-probe/probe"
+	"github.com/raintank/raintank-probe/scheduler"
+	m "github.com/raintank/worldping-api/pkg/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// exit codes of the check subcommand, matching the nagios plugin conventions.
+const (
+	checkExitOK       = 0
+	checkExitWarning  = 1
+	checkExitCritical = 2
+	checkExitUnknown  = 3
+)
+
+type checkOutput struct {
+	Type     m.CheckType        `json:"type"`
+	Result   checks.CheckResult `json:"result"`
+	Error    string             `json:"error"`
+	Warning  string             `json:"warning"`
+	Duration float64            `json:"duration"`
+	Metrics  []checkMetric      `json:"metrics"`
+}
+
+type checkMetric struct {
+	Name  string  `json:"name"`
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit"`
+}
+
+// runCheckCmd implements `raintank-probe check`, which runs a single check once
+// and prints the result. The return value is the process exit code.
+func runCheckCmd(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	checkType := fs.String("type", "", "type of check to run. one of ping, dns, http or https.")
+	settings := fs.String("settings", "{}", "check settings as a JSON object.")
+	slug := fs.String("endpoint-slug", "check", "endpoint slug used in the metric names.")
+	probeSlug := fs.String("probe-slug", "local", "probe slug used in the metric names.")
+	frequency := fs.Int64("frequency", 60, "check frequency in seconds, used as the metric interval.")
+	format := fs.String("format", "json", "output format. json or table.")
+	level := fs.Int("log-level", 3, "log level. 0=TRACE|1=DEBUG|2=INFO|3=WARN|4=ERROR|5=FATAL|6=PANIC")
+	if err := fs.Parse(args); err != nil {
+		return checkExitUnknown
+	}
+	initLogger(*level)
+
+	if *format != "json" && *format != "table" {
+		fmt.Fprintf(os.Stderr, "invalid format %q, must be json or table.\n", *format)
+		return checkExitUnknown
+	}
+	check := &m.CheckWithSlug{
+		Check: m.Check{
+			OrgId:     1,
+			Type:      m.CheckType(*checkType),
+			Frequency: *frequency,
+			Enabled:   true,
+		},
+		Slug: *slug,
+	}
+	if err := json.Unmarshal([]byte(*settings), &check.Settings); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid settings: %s\n", err)
+		return checkExitUnknown
+	}
+	if _, err := scheduler.GetCheck(check.Type, check.Settings); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid check: %s\n", err)
+		return checkExitUnknown
+	}
+	probe.Self = &m.ProbeDTO{Slug: *probeSlug, Name: *probeSlug}
+
+	// only ping checks need the raw sockets of the GlobalPinger.
+	if check.Type == m.PING_CHECK {
+		checks.InitPinger()
+		defer checks.GlobalPinger.Stop()
+	}
+
+	start := time.Now()
+	result, metrics, err := scheduler.Execute(check, start)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to execute check: %s\n", err)
+		return checkExitUnknown
+	}
+	out := checkOutput{
+		Type:     check.Type,
+		Result:   result,
+		Error:    result.ErrorMsg(),
+		Warning:  scheduler.Warning(check, result),
+		Duration: time.Since(start).Seconds() * 1000,
+		Metrics:  make([]checkMetric, len(metrics)),
+	}
+	for i, md := range metrics {
+		out.Metrics[i] = checkMetric{Name: md.Name, Value: md.Value, Unit: md.Unit}
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(out); err != nil {
+			log.Errorf("unable to encode result. %s", err)
+			return checkExitUnknown
+		}
+	} else {
+		printCheckTable(out)
+	}
+
+	if out.Error != "" {
+		return checkExitCritical
+	}
+	if out.Warning != "" {
+		return checkExitWarning
+	}
+	return checkExitOK
+}
+
+func printCheckTable(out checkOutput) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	status := "OK"
+	if out.Error != "" {
+		status = "CRITICAL: " + out.Error
+	} else if out.Warning != "" {
+		status = "WARNING: " + out.Warning
+	}
+	fmt.Fprintf(w, "STATUS\t%s\n", status)
+	fmt.Fprintf(w, "DURATION\t%.3fms\n", out.Duration)
+
+	// print the result fields using their json names.
+	fields := make(map[string]interface{})
+	body, _ := json.Marshal(out.Result)
+	json.Unmarshal(body, &fields)
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "\nFIELD\tVALUE")
+	for _, name := range names {
+		if fields[name] == nil {
+			fmt.Fprintf(w, "%s\t-\n", name)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%v\n", name, fields[name])
+	}
+
+	fmt.Fprintln(w, "\nMETRIC\tVALUE\tUNIT")
+	for _, md := range out.Metrics {
+		fmt.Fprintf(w, "%s\t%v\t%s\n", md.Name, md.Value, md.Unit)
+	}
+	w.Flush()
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ini "github.com/glacjay/goini"
+	"github.com/raintank/raintank-probe/checks"
+	"github.com/raintank/raintank-probe/scheduler"
+	"github.com/raintank/raintank-probe/standalone"
+	m "github.com/raintank/worldping-api/pkg/models"
+	"github.com/rakyll/globalconf"
+)
+
+const envPrefix = "RTPROBE_"
+
+// loadConfig sets any flags not passed on the command line from the
+// configuration file and RTPROBE_ environment variables. globalconf silently
+// ignores unknown keys and invalid values, so the returned list holds every
+// problem found with the configuration. An error is returned if the
+// configuration file can not be parsed at all.
+func loadConfig() ([]error, error) {
+	// Set 'cfile' here if *confFile exists, because we should only try and
+	// parse the conf file if it exists. If we try and parse the default
+	// conf file location when it's not there, we (unsurprisingly) get a
+	// panic.
+	var cfile string
+	if _, err := os.Stat(*confFile); err == nil {
+		cfile = *confFile
+	}
+
+	cmdline := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		cmdline[f.Name] = true
+	})
+
+	// Still parse globalconf, though, even if the config file doesn't exist
+	// because we want to be able to use environment variables.
+	conf, err := globalconf.NewWithOptions(&globalconf.Options{
+		Filename:  cfile,
+		EnvPrefix: envPrefix,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error with configuration file: %s", err)
+	}
+	conf.ParseAll()
+
+	errs, err := checkConfigSources(cfile, cmdline)
+	if err != nil {
+		return nil, err
+	}
+	return append(errs, checkConfigValues()...), nil
+}
+
+// checkConfigSources returns an error for every unknown key or invalid value
+// in the configuration file and environment.
+func checkConfigSources(cfile string, cmdline map[string]bool) ([]error, error) {
+	var errs []error
+	envSet := make(map[string]bool)
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, envPrefix) {
+			continue
+		}
+		parts := strings.SplitN(env, "=", 2)
+		name := strings.Replace(strings.ToLower(strings.TrimPrefix(parts[0], envPrefix)), "_", "-", -1)
+		if flag.Lookup(name) == nil {
+			errs = append(errs, fmt.Errorf("unknown environment variable %s", parts[0]))
+			continue
+		}
+		envSet[name] = true
+		if !cmdline[name] {
+			if err := flag.Set(name, parts[1]); err != nil {
+				errs = append(errs, fmt.Errorf("invalid value %q for %s: %s", parts[1], parts[0], err))
+			}
+		}
+	}
+
+	if cfile == "" {
+		return errs, nil
+	}
+	dict, err := ini.Load(cfile)
+	if err != nil {
+		return nil, fmt.Errorf("error with configuration file: %s", err)
+	}
+	sections := dict.GetSections()
+	sort.Strings(sections)
+	for _, section := range sections {
+		keys := make([]string, 0, len(dict[section]))
+		for key := range dict[section] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := dict[section][key]
+			if section != "" || flag.Lookup(key) == nil {
+				if section != "" {
+					key = section + "." + key
+				}
+				errs = append(errs, fmt.Errorf("unknown key %q in %s", key, cfile))
+				continue
+			}
+			if cmdline[key] || envSet[key] {
+				continue
+			}
+			if err := flag.Set(key, value); err != nil {
+				errs = append(errs, fmt.Errorf("invalid value %q for %s in %s: %s", value, key, cfile, err))
+			}
+		}
+	}
+	return errs, nil
+}
+
+// checkConfigValues returns an error for every setting that would otherwise
+// only be rejected once the probe is running.
+func checkConfigValues() []error {
+	var errs []error
+	if *logLevel < 0 || *logLevel > 6 {
+		errs = append(errs, fmt.Errorf("log-level must be between 0 and 6"))
+	}
+	if *nodeName == "" {
+		errs = append(errs, fmt.Errorf("name must be set"))
+	}
+	if *concurrency < 1 {
+		errs = append(errs, fmt.Errorf("concurrency must be greater than 0"))
+	}
+
+	for _, name := range []string{"destination-allow", "destination-deny"} {
+		if _, err := checks.ParseCIDRs(flag.Lookup(name).Value.String()); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s. %s", name, err))
+		}
+	}
+	if *destinationRateLimit < 0 {
+		errs = append(errs, fmt.Errorf("destination-rate-limit must not be negative"))
+	}
+
+	if _, err := scheduler.ParseHealthTargets(*healthTargets); err != nil {
+		errs = append(errs, err)
+	}
+	if *healthThreshold <= 0 || *healthThreshold >= 1 {
+		errs = append(errs, fmt.Errorf("health-threshold must be between 0 and 1"))
+	}
+	if *healthHysteresis < 1 {
+		errs = append(errs, fmt.Errorf("health-hysteresis must be greater than 0"))
+	}
+
+	if *overrunEventThreshold < 0 {
+		errs = append(errs, fmt.Errorf("overrun-event-threshold must not be negative"))
+	}
+	if *maxConcurrentChecks < 0 {
+		errs = append(errs, fmt.Errorf("max-concurrent-checks must not be negative"))
+	}
+	if _, err := parseTypeConcurrency(*checkTypeConcurrency); err != nil {
+		errs = append(errs, err)
+	}
+	if *flapWindow < 0 {
+		errs = append(errs, fmt.Errorf("flap-window must not be negative"))
+	}
+	if *flapLowThreshold < 0 || *flapHighThreshold > 1 || *flapLowThreshold > *flapHighThreshold {
+		errs = append(errs, fmt.Errorf("flap thresholds must be between 0 and 1, with flap-low-threshold no greater than flap-high-threshold"))
+	}
+
+	if !*standaloneMode {
+		count := 0
+		for _, addr := range strings.Split(*serverAddr, ",") {
+			addr = strings.TrimSpace(addr)
+			if addr == "" {
+				continue
+			}
+			count++
+			if err := checkURL("server-url", addr, "ws", "wss"); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if count == 0 {
+			errs = append(errs, fmt.Errorf("server-url must be set"))
+		}
+	}
+
+	tsdbEnabled := false
+	for _, name := range strings.Split(*publisherSinks, ",") {
+		switch strings.TrimSpace(name) {
+		case "tsdb":
+			tsdbEnabled = true
+		case "jsonl", "":
+		default:
+			errs = append(errs, fmt.Errorf("unknown publisher sink %q", name))
+		}
+	}
+	if tsdbEnabled {
+		if err := checkURL("tsdb-url", *tsdbAddr, "http", "https"); err != nil {
+			errs = append(errs, err)
+		}
+		if *tsdbProxy != "" {
+			if err := checkURL("tsdb-proxy", *tsdbProxy, "http", "https", "socks5"); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		for _, name := range []string{"tsdb-ca-cert", "tsdb-client-cert", "tsdb-client-key"} {
+			path := flag.Lookup(name).Value.String()
+			if path == "" {
+				continue
+			}
+			if _, err := os.Stat(path); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s", name, err))
+			}
+		}
+		if (*tsdbClientCert == "") != (*tsdbClientKey == "") {
+			errs = append(errs, fmt.Errorf("tsdb-client-cert and tsdb-client-key must be set together"))
+		}
+	}
+
+	// every duration flag must be positive or 0.
+	flag.VisitAll(func(f *flag.Flag) {
+		getter, ok := f.Value.(flag.Getter)
+		if !ok {
+			return
+		}
+		if d, ok := getter.Get().(time.Duration); ok && d < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", f.Name))
+		}
+	})
+
+	for _, name := range []string{"healthz-listen-addr", "api-listen-addr"} {
+		addr := flag.Lookup(name).Value.String()
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s: %s", name, err))
+		}
+	}
+	if *apiListenAddr != "" && *apiToken == "" {
+		errs = append(errs, fmt.Errorf("api-token must be set when api-listen-addr is set"))
+	}
+
+	if *standaloneMode {
+		_, err := standalone.Load(*checksFile, slugify(*nodeName))
+		if checkErrs, ok := err.(standalone.Errors); ok {
+			for _, e := range checkErrs {
+				errs = append(errs, fmt.Errorf("checks-file %s: %s", *checksFile, e))
+			}
+		} else if err != nil {
+			errs = append(errs, fmt.Errorf("checks-file %s: %s", *checksFile, err))
+		}
+	}
+	return errs
+}
+
+// parseTypeConcurrency parses the check-type-concurrency flag, a comma
+// separated list of type=limit pairs.
+func parseTypeConcurrency(value string) (map[m.CheckType]int, error) {
+	limits := make(map[m.CheckType]int)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid check-type-concurrency %q. must be type=limit", pair)
+		}
+		checkType := m.CheckType(strings.TrimSpace(parts[0]))
+		switch checkType {
+		case m.PING_CHECK, m.DNS_CHECK, m.HTTP_CHECK, m.HTTPS_CHECK:
+		default:
+			return nil, fmt.Errorf("invalid check-type-concurrency %q. unknown check type %s", pair, checkType)
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid check-type-concurrency %q. limit must be a positive number", pair)
+		}
+		limits[checkType] = limit
+	}
+	return limits, nil
+}
+
+func checkURL(name, addr string, schemes ...string) error {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return fmt.Errorf("unable to parse %s: %s", name, err)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid %s. no host set", name)
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid %s. scheme must be one of %s. was %s", name, strings.Join(schemes, ", "), u.Scheme)
+}
+
+// runValidateConfigCmd implements `raintank-probe validate-config`, which
+// reports all problems with the configuration and exits.
+func runValidateConfigCmd(args []string) int {
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return 2
+	}
+	errs, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(errs) == 0 {
+		fmt.Println("configuration OK")
+		return 0
+	}
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	fmt.Fprintf(os.Stderr, "found %d configuration errors\n", len(errs))
+	return 1
+}
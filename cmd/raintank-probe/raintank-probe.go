@@ -14,13 +14,15 @@ import (
 
 	"github.com/grafana/metrictank/stats"
 	"github.com/raintank/metrictank/logger"
+	"github.com/raintank/raintank-probe/api"
 	"github.com/raintank/raintank-probe/checks"
 	"github.com/raintank/raintank-probe/controller"
 	"github.com/raintank/raintank-probe/healthz"
+	"github.com/raintank/raintank-probe/probe"
 	"github.com/raintank/raintank-probe/publisher"
 	"github.com/raintank/raintank-probe/scheduler"
+	"github.com/raintank/raintank-probe/standalone"
 	m "github.com/raintank/worldping-api/pkg/models"
-	"github.com/rakyll/globalconf"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -32,13 +34,70 @@ var (
 	logLevel    = flag.Int("log-level", 2, "log level. 0=TRACE|1=DEBUG|2=INFO|3=WARN|4=ERROR|5=FATAL|6=PANIC")
 	confFile    = flag.String("config", "/etc/raintank/probe.ini", "configuration file path")
 
-	serverAddr  = flag.String("server-url", "ws://localhost:80/", "address of worldping-api server")
+	serverAddr  = flag.String("server-url", "ws://localhost:80/", "address of worldping-api server. A comma separated list of addresses can be given, in order of priority, to fail over between servers.")
 	tsdbAddr    = flag.String("tsdb-url", "http://localhost:80/", "address of tsdb server")
 	nodeName    = flag.String("name", "", "agent-name")
 	apiKey      = flag.String("api-key", "not_very_secret_key", "Api Key")
 	concurrency = flag.Int("concurrency", 5, "concurrency number of requests to TSDB.")
 	healthHosts = flag.String("health-hosts", "google.com,youtube.com,facebook.com,twitter.com,wikipedia.com", "comma separted list of hosts to ping to determin network health of this probe.")
 
+	connectDeadline   = flag.Duration("server-connect-deadline", 0, "how long to keep retrying the initial connection to the worldping-api server before exiting. 0 means retry forever.")
+	failbackInterval  = flag.Duration("server-failback-interval", time.Minute*10, "how long to stay connected to a secondary worldping-api server before trying the first server-url again. 0 disables failing back.")
+	assignmentsFile   = flag.String("assignments-file", "", "file to save the checks assigned by the worldping-api server to, so they can be run after a restart while the server is unreachable. Disabled if empty.")
+	assignmentsMaxAge = flag.Duration("assignments-max-age", time.Hour*24, "maximum age of the checks in assignments-file to run on startup. 0 means no limit.")
+	statusInterval    = flag.Duration("status-interval", time.Minute, "how often to send the probe status to the worldping-api server. 0 disables it.")
+	checkStateFile    = flag.String("check-state-file", "", "file to save the state of each check to, so checks continue from their previous state after a restart instead of sending new state change events. Disabled if empty.")
+
+	// flap detection
+	flapWindow        = flag.Int("flap-window", 20, "number of runs of a check over which state changes are counted to detect flapping. 0 disables flap detection.")
+	flapHighThreshold = flag.Float64("flap-high-threshold", 0.5, "share of runs in flap-window that must change state for a check to be considered flapping.")
+	flapLowThreshold  = flag.Float64("flap-low-threshold", 0.25, "share of runs in flap-window that change state at or below which a flapping check is considered stable again.")
+
+	// probe health
+	healthTargets    = flag.String("health-targets", "", "comma separated list of targets checked to determine the health of this probe, eg. ping:google.com,dns:8.8.8.8,tcp:example.com:443,https://example.com/=2. If empty, health-hosts are pinged.")
+	healthInterval   = flag.Duration("health-interval", time.Second*5, "how often the health targets are checked.")
+	healthTimeout    = flag.Duration("health-timeout", time.Second*2, "timeout for each check of a health target.")
+	healthThreshold  = flag.Float64("health-threshold", 0.5, "share of the total weight of the health targets that must fail for this probe to be unhealthy and stop executing checks.")
+	healthHysteresis = flag.Int("health-hysteresis", 1, "number of consecutive health evaluations needed before checks are stopped or resumed.")
+
+	// check execution limits
+	maxConcurrentChecks   = flag.Int("max-concurrent-checks", 0, "maximum number of checks to execute at the same time. 0 means unlimited.")
+	spreadOffsets         = flag.Bool("spread-offsets", false, "spread checks that have no offset across their frequency, instead of running them all at the start of each interval.")
+	overrunEventThreshold = flag.Int("overrun-event-threshold", 3, "number of times a check can be due while its previous run is still in progress, without a run completing within the check frequency, before a WARN event is sent. 0 disables the event.")
+	coalesceChecks        = flag.Bool("coalesce-checks", false, "execute identical checks, with the same type and settings, that are due at the same time only once and share the result between them.")
+	checkTypeConcurrency  = flag.String("check-type-concurrency", "", "comma separated list of type=limit pairs limiting the number of checks of each type executing at the same time, eg. ping=100,http=20.")
+
+	// destinations checks can connect to
+	destinationAllow     = flag.String("destination-allow", "", "comma separated list of CIDR ranges checks are allowed to connect to. If empty, all addresses not otherwise blocked are allowed.")
+	destinationDeny      = flag.String("destination-deny", "", "comma separated list of CIDR ranges checks are not allowed to connect to.")
+	blockPrivate         = flag.Bool("destination-block-private", false, "do not allow checks to connect to loopback, private or link-local addresses.")
+	destinationRateLimit = flag.Float64("destination-rate-limit", 0, "maximum number of checks per second to a single address. 0 means unlimited.")
+	destinationRateBurst = flag.Int("destination-rate-burst", 10, "number of checks that can be made to a single address at once when destination-rate-limit is set.")
+
+	// tsdb-gw http transport
+	tsdbProxy                 = flag.String("tsdb-proxy", "", "proxy url to use for connecting to tsdb server. Defaults to the HTTP_PROXY/HTTPS_PROXY environment variables.")
+	tsdbTimeout               = flag.Duration("tsdb-timeout", time.Second*10, "timeout for requests to the tsdb server.")
+	tsdbDialTimeout           = flag.Duration("tsdb-dial-timeout", time.Second*30, "timeout for establishing connections to the tsdb server.")
+	tsdbTLSHandshakeTimeout   = flag.Duration("tsdb-tls-handshake-timeout", time.Second*10, "timeout for TLS handshakes with the tsdb server.")
+	tsdbResponseHeaderTimeout = flag.Duration("tsdb-response-header-timeout", 0, "timeout waiting for response headers from the tsdb server. 0 means no timeout other than tsdb-timeout.")
+	tsdbIdleConnTimeout       = flag.Duration("tsdb-idle-conn-timeout", time.Second*90, "how long idle connections to the tsdb server are kept open.")
+	tsdbMaxIdleConns          = flag.Int("tsdb-max-idle-conns", 100, "maximum number of idle connections to the tsdb server.")
+	tsdbMaxIdleConnsPerHost   = flag.Int("tsdb-max-idle-conns-per-host", 0, "maximum number of idle connections per tsdb host. 0 uses the Go default of 2.")
+	tsdbHTTP2                 = flag.Bool("tsdb-http2", false, "enable HTTP/2 for connections to the tsdb server.")
+	tsdbCACert                = flag.String("tsdb-ca-cert", "", "path to a PEM encoded CA bundle used to verify the tsdb server certificate.")
+	tsdbClientCert            = flag.String("tsdb-client-cert", "", "path to a PEM encoded client certificate for mTLS to the tsdb server.")
+	tsdbClientKey             = flag.String("tsdb-client-key", "", "path to the PEM encoded key for tsdb-client-cert.")
+	tsdbTLSSkipVerify         = flag.Bool("tsdb-tls-skip-verify", false, "skip verification of the tsdb server certificate.")
+	tsdbMaxRetries            = flag.Int("tsdb-max-retries", 0, "maximum number of attempts to send a batch to the tsdb server on retryable errors. 0 means no limit.")
+	tsdbMaxRetryTime          = flag.Duration("tsdb-max-retry-time", time.Hour, "how long to keep retrying a batch that fails with retryable errors before giving up. 0 means no limit.")
+	tsdbDeadLetterFile        = flag.String("tsdb-dead-letter-file", "", "file to append batches that could not be delivered to the tsdb server to. If empty, they are dropped.")
+
+	// publisher sinks
+	publisherSinks  = flag.String("publisher-sinks", "tsdb", "comma separated list of sinks to publish results to. Valid sinks are tsdb and jsonl.")
+	jsonlPath       = flag.String("jsonl-path", "-", "file to write check results and events to as JSON lines when the jsonl sink is enabled. Use - for stdout.")
+	jsonlMaxSize    = flag.Int64("jsonl-max-size", 100, "size in MB at which the jsonl file is rotated. 0 disables rotation.")
+	jsonlMaxBackups = flag.Int("jsonl-max-backups", 5, "number of rotated jsonl files to keep.")
+
 	statsEnabled    = flag.Bool("stats-enabled", false, "enable sending graphite messages for instrumentation")
 	statsPrefix     = flag.String("stats-prefix", "raintank-probe.stats.$hostname", "stats prefix (will add trailing dot automatically if needed)")
 	statsAddr       = flag.String("stats-addr", "localhost:2003", "graphite address")
@@ -46,36 +105,42 @@ var (
 	statsBufferSize = flag.Int("stats-buffer-size", 20000, "how many messages (holding all measurements from one interval) to buffer up in case graphite endpoint is unavailable.")
 	statsTimeout    = flag.Duration("stats-timeout", time.Second*10, "timeout after which a write is considered not successful")
 
+	// standalone mode
+	standaloneMode = flag.Bool("standalone", false, "run without a worldping-api controller, using the checks defined in checks-file.")
+	checksFile     = flag.String("checks-file", "/etc/raintank/checks.json", "path to the JSON file defining the probe identity and checks to run in standalone mode.")
+	checksFilePoll = flag.Duration("checks-file-poll-interval", time.Second*10, "how often to check checks-file for changes in standalone mode. 0 disables polling, the file is still re-read on SIGHUP.")
+
 	// healthz endpoint
 	healthzListenAddr = flag.String("healthz-listen-addr", "localhost:7180", "address to listen on for healthz http api.")
 
+	// check management api
+	apiListenAddr = flag.String("api-listen-addr", "", "address to listen on for the check management http api. Disabled if empty.")
+	apiToken      = flag.String("api-token", "", "bearer token required for requests to the check management api.")
+
 	MonitorTypes map[string]m.MonitorTypeDTO
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check":
+			os.Exit(runCheckCmd(os.Args[2:]))
+		case "validate-config":
+			os.Exit(runValidateConfigCmd(os.Args[2:]))
+		}
+	}
 	flag.Parse()
-	// Set 'cfile' here if *confFile exists, because we should only try and
-	// parse the conf file if it exists. If we try and parse the default
-	// conf file location when it's not there, we (unsurprisingly) get a
-	// panic.
-	var cfile string
-	if _, err := os.Stat(*confFile); err == nil {
-		cfile = *confFile
-	}
-
-	// Still parse globalconf, though, even if the config file doesn't exist
-	// because we want to be able to use environment variables.
-	conf, err := globalconf.NewWithOptions(&globalconf.Options{
-		Filename:  cfile,
-		EnvPrefix: "RTPROBE_",
-	})
+	configErrs, err := loadConfig()
 	if err != nil {
-		panic(fmt.Sprintf("error with configuration file: %s", err))
+		log.Fatal(err)
 	}
-	conf.ParseAll()
 
 	initLogger(*logLevel)
 
+	for _, err := range configErrs {
+		log.Warning(err)
+	}
+
 	if *showVersion {
 		fmt.Printf("raintank-probe (built with %s, git hash %s)\n", runtime.Version(), GitHash)
 		return
@@ -101,35 +166,176 @@ func main() {
 	if !strings.HasPrefix(tsdbUrl.Path, "/") {
 		tsdbUrl.Path += "/"
 	}
-	publisher.Init(tsdbUrl, *apiKey, *concurrency)
+	sinks := make([]publisher.Sink, 0)
+	for _, name := range strings.Split(*publisherSinks, ",") {
+		switch strings.TrimSpace(name) {
+		case "tsdb":
+			tsdb, err := publisher.NewTsdb(&publisher.TsdbConfig{
+				Url:            tsdbUrl,
+				ApiKey:         *apiKey,
+				Concurrency:    *concurrency,
+				MaxRetries:     *tsdbMaxRetries,
+				MaxRetryTime:   *tsdbMaxRetryTime,
+				DeadLetterFile: *tsdbDeadLetterFile,
+				Transport: publisher.TransportConfig{
+					ProxyURL:              *tsdbProxy,
+					Timeout:               *tsdbTimeout,
+					DialTimeout:           *tsdbDialTimeout,
+					KeepAlive:             time.Second * 30,
+					TLSHandshakeTimeout:   *tsdbTLSHandshakeTimeout,
+					ResponseHeaderTimeout: *tsdbResponseHeaderTimeout,
+					IdleConnTimeout:       *tsdbIdleConnTimeout,
+					MaxIdleConns:          *tsdbMaxIdleConns,
+					MaxIdleConnsPerHost:   *tsdbMaxIdleConnsPerHost,
+					EnableHTTP2:           *tsdbHTTP2,
+					CACertFile:            *tsdbCACert,
+					ClientCertFile:        *tsdbClientCert,
+					ClientKeyFile:         *tsdbClientKey,
+					InsecureSkipVerify:    *tsdbTLSSkipVerify,
+				},
+			})
+			if err != nil {
+				log.Fatalf("unable to initialize tsdb publisher: %s", err)
+			}
+			sinks = append(sinks, tsdb)
+		case "jsonl":
+			jsonl, err := publisher.NewJsonl(publisher.JsonlConfig{
+				Path:       *jsonlPath,
+				MaxSize:    *jsonlMaxSize * 1024 * 1024,
+				MaxBackups: *jsonlMaxBackups,
+			})
+			if err != nil {
+				log.Fatalf("unable to initialize jsonl publisher: %s", err)
+			}
+			sinks = append(sinks, jsonl)
+		case "":
+		default:
+			log.Fatalf("unknown publisher sink %q", name)
+		}
+	}
+	if len(sinks) == 0 {
+		log.Fatal("at least one publisher sink must be enabled.")
+	}
+	publisher.Init(sinks...)
+
+	allow, err := checks.ParseCIDRs(*destinationAllow)
+	if err != nil {
+		log.Fatalf("invalid destination-allow. %s", err)
+	}
+	deny, err := checks.ParseCIDRs(*destinationDeny)
+	if err != nil {
+		log.Fatalf("invalid destination-deny. %s", err)
+	}
+	checks.GlobalPolicy = &checks.DestinationPolicy{
+		Allow:        allow,
+		Deny:         deny,
+		BlockPrivate: *blockPrivate,
+		RateLimit:    *destinationRateLimit,
+		RateBurst:    *destinationRateBurst,
+	}
 
 	// init the GlobalPinger. go-pinger uses raw sockets, so if the process does not have CAP_NET
 	// privileges, the process will panic.
 	checks.InitPinger()
 
-	jobScheduler := scheduler.New(*healthHosts)
+	typeConcurrency, err := parseTypeConcurrency(*checkTypeConcurrency)
+	if err != nil {
+		log.Fatal(err)
+	}
+	targets, err := scheduler.ParseHealthTargets(*healthTargets)
+	if err != nil {
+		log.Fatal(err)
+	}
+	jobScheduler := scheduler.New(*healthHosts, &scheduler.Config{
+		FlapWindow:        *flapWindow,
+		FlapHighThreshold: *flapHighThreshold,
+		FlapLowThreshold:  *flapLowThreshold,
+		MaxConcurrency:    *maxConcurrentChecks,
+		TypeConcurrency:   typeConcurrency,
+		SpreadOffsets:     *spreadOffsets,
+		CoalesceChecks:    *coalesceChecks,
+
+		OverrunEventThreshold: *overrunEventThreshold,
+		StateFile:             *checkStateFile,
+		Health: scheduler.HealthConfig{
+			Targets:    targets,
+			Interval:   *healthInterval,
+			Timeout:    *healthTimeout,
+			Threshold:  *healthThreshold,
+			Hysteresis: *healthHysteresis,
+		},
+	})
 	go jobScheduler.CheckHealth()
 
 	healthz := healthz.NewHealthz(jobScheduler, *healthzListenAddr)
 
-	version := strings.Split(GitHash, "-")[0]
-	controllerCfg := &controller.ControllerConfig{
-		ServerAddr:   *serverAddr,
-		ApiKey:       *apiKey,
-		NodeName:     *nodeName,
-		Version:      version,
-		JobScheduler: jobScheduler,
+	var checksApi *api.Api
+	if *apiListenAddr != "" {
+		if *apiToken == "" {
+			log.Fatal("api-token must be set when api-listen-addr is set.")
+		}
+		checksApi = api.NewApi(jobScheduler, *apiListenAddr, *apiToken)
+	}
+
+	var ctrl *controller.Controller
+	var checksSource *standalone.Source
+	shutdown := make(chan struct{})
+	if *standaloneMode {
+		checksSource = standalone.NewSource(*checksFile, slugify(*nodeName))
+		cfg, err := checksSource.Load()
+		if err != nil {
+			log.Fatalf("unable to load checks-file %s: %s", *checksFile, err)
+		}
+		log.Infof("running in standalone mode as probe %s with %d checks from %s", cfg.Probe.Slug, len(cfg.Checks), *checksFile)
+		probe.Self = cfg.Probe
+		jobScheduler.Refresh(cfg.Checks)
+		if *checksFilePoll > 0 {
+			go checksSource.Watch(*checksFilePoll, shutdown, func() {
+				reloadChecks(checksSource, jobScheduler)
+			})
+		}
+	} else {
+		version := strings.Split(GitHash, "-")[0]
+		controllerCfg := &controller.ControllerConfig{
+			ServerAddr:   *serverAddr,
+			ApiKey:       *apiKey,
+			NodeName:     *nodeName,
+			Version:      version,
+			JobScheduler: jobScheduler,
+
+			ConnectDeadline:   *connectDeadline,
+			AssignmentsFile:   *assignmentsFile,
+			AssignmentsMaxAge: *assignmentsMaxAge,
+			StatusInterval:    *statusInterval,
+			FailbackInterval:  *failbackInterval,
+		}
+		ctrl = controller.NewController(controllerCfg)
 	}
-	controller := controller.NewController(controllerCfg)
 
 	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
 	//wait for interupt Signal.
-	<-interrupt
+	for sig := range interrupt {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if checksSource == nil {
+			log.Info("received SIGHUP, nothing to reload.")
+			continue
+		}
+		log.Info("received SIGHUP, reloading checks-file")
+		reloadChecks(checksSource, jobScheduler)
+	}
 	log.Info("Shutting down")
-	controller.Stop()
+	close(shutdown)
+	if ctrl != nil {
+		ctrl.Stop()
+	}
 	healthz.Stop()
+	if checksApi != nil {
+		checksApi.Stop()
+	}
 	jobScheduler.Close()
 	publisher.Stop()
 	checks.GlobalPinger.Stop()
@@ -137,6 +343,30 @@ func main() {
 	return
 }
 
+// reloadChecks re-reads the checks file and applies any changes to the scheduler.
+// If the file is invalid, the currently running checks are left untouched.
+func reloadChecks(source *standalone.Source, jobScheduler *scheduler.Scheduler) {
+	cfg, err := source.Load()
+	if err != nil {
+		log.Errorf("unable to reload checks-file %s, keeping current checks: %s", source.Path, err)
+		return
+	}
+	if cfg.Probe.Slug != probe.Self.Slug {
+		log.Warningf("probe identity in %s has changed, a restart is required for it to take effect.", source.Path)
+	}
+	jobScheduler.Refresh(cfg.Checks)
+}
+
+// slugify converts a probe name into the form used for the probe slug in metric names.
+func slugify(name string) string {
+	return strings.ToLower(strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == '-' {
+			return r
+		}
+		return '-'
+	}, strings.TrimSpace(name)))
+}
+
 func initLogger(level int) {
 	formatter := &logger.TextFormatter{}
 	formatter.TimestampFormat = "2006-01-02 15:04:05.000"
@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/raintank/raintank-probe/probe"
+	"github.com/raintank/raintank-probe/scheduler"
+	m "github.com/raintank/worldping-api/pkg/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// assignments are the last checks received from the controller, saved to the
+// assignments file so that the probe can run them after a restart while the
+// controller is unreachable.
+type assignments struct {
+	Saved  time.Time          `json:"saved"`
+	Probe  *m.ProbeDTO        `json:"probe"`
+	Checks []*m.CheckWithSlug `json:"checks"`
+}
+
+// loadAssignments reads the assignments file. An error is returned if the file is
+// older than maxAge. A maxAge of 0 accepts files of any age.
+func loadAssignments(path string, maxAge time.Duration) (*assignments, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &assignments{}
+	if err := json.Unmarshal(body, a); err != nil {
+		return nil, fmt.Errorf("unable to parse %s. %s", path, err)
+	}
+	if a.Probe == nil {
+		return nil, fmt.Errorf("no probe found in %s", path)
+	}
+	age := time.Since(a.Saved)
+	if maxAge > 0 && age > maxAge {
+		return nil, fmt.Errorf("%s is too old. saved %s ago", path, age)
+	}
+	return a, nil
+}
+
+// saveAssignments writes the checks to the assignments file, if one is set.
+// It must only be called after the ready event, once probe.Self is current.
+func (c *Controller) saveAssignments(checks []*m.CheckWithSlug) {
+	if c.assignmentsFile == "" {
+		return
+	}
+	if err := saveAssignments(c.assignmentsFile, checks); err != nil {
+		log.Errorf("unable to save checks to %s. %s", c.assignmentsFile, err)
+	}
+}
+
+// saveAssignments writes the checks and probe.Self to the assignments file.
+func saveAssignments(path string, checks []*m.CheckWithSlug) error {
+	if probe.Self == nil {
+		return fmt.Errorf("probe details not yet received from controller")
+	}
+	body, err := json.Marshal(assignments{
+		Saved:  time.Now(),
+		Probe:  probe.Self,
+		Checks: checks,
+	})
+	if err != nil {
+		return err
+	}
+	return scheduler.WriteFileAtomic(path, body)
+}
+
+// seedScheduler starts the checks from the assignments file, if it is present
+// and recent enough. They are reconciled with the controller's list on the first
+// refresh after connecting.
+func (c *Controller) seedScheduler() {
+	a, err := loadAssignments(c.assignmentsFile, c.assignmentsMaxAge)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Infof("no assignments file found at %s", c.assignmentsFile)
+		} else {
+			log.Warnf("not using saved checks. %s", err)
+		}
+		return
+	}
+	log.Infof("starting %d checks saved at %s from %s", len(a.Checks), a.Saved, c.assignmentsFile)
+	probe.Self = a.Probe
+	c.jobScheduler.Refresh(a.Checks)
+}
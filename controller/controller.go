@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"strings"
 	"sync"
 	"time"
 
@@ -26,39 +27,157 @@ var (
 )
 
 type ControllerConfig struct {
+	// comma separated list of controller URLs, in order of priority.
 	ServerAddr   string
 	ApiKey       string
 	NodeName     string
 	Version      string
 	JobScheduler *scheduler.Scheduler
+
+	// how long to keep retrying the initial connection before giving up.
+	// 0 means retry forever.
+	ConnectDeadline time.Duration
+
+	// file to save the checks received from the controller to, so they can
+	// be run after a restart while the controller is unreachable. Disabled if
+	// empty. Saved checks older than AssignmentsMaxAge are ignored.
+	AssignmentsFile   string
+	AssignmentsMaxAge time.Duration
+
+	// how often to send the probe status to the controller. 0 disables it.
+	StatusInterval time.Duration
+
+	// how long to stay connected to a secondary controller before trying the
+	// primary again. 0 disables failing back.
+	FailbackInterval time.Duration
+}
+
+// errors emitted by the controller that will not be resolved by reconnecting,
+// eg. a bad api key or an unknown probe name.
+//
+// worldping-api sends the reason for an "error" event as free-form text, with
+// no error code, when it rejects the registration of a probe. The lower case
+// phrases below are matched against that text. As the text is not part of a
+// stable protocol, they are only applied to errors received before the "ready"
+// event, when the connection is still being registered. Errors received after
+// that are always treated as transient.
+var fatalControllerErrors = []string{
+	"api key",
+	"apikey",
+	"unauthorized",
+	"authentication",
+	"permission denied",
+	"probe not found",
+	"unknown probe",
+	"invalid probe",
+	"probe name",
+	"name is required",
+}
+
+// isFatalControllerError returns true if the reason sent with an "error" event
+// before the "ready" event indicates a configuration problem, rather than a
+// transient failure.
+func isFatalControllerError(reason string) bool {
+	reason = strings.ToLower(reason)
+	for _, e := range fatalControllerErrors {
+		if strings.Contains(reason, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// session is the state of a single connection to the controller.
+type session struct {
+	sync.Mutex
+	// set once the controller has sent the ready event, accepting the probe.
+	ready bool
+	// checks refreshed before the ready event, saved to the assignments file
+	// once the probe details from the ready event are known.
+	pending []*m.CheckWithSlug
+	// closed when the control loop of the connection ends, after which
+	// eventChan may be closed.
+	done chan struct{}
+}
+
+func (s *session) isReady() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.ready
 }
 
 type Controller struct {
 	sync.Mutex
 
-	URL          *url.URL
-	readyChan    chan m.ProbeReadyPayload
-	shutdown     chan struct{}
-	jobScheduler *scheduler.Scheduler
+	endpoints       []*endpoint
+	current         int
+	readyChan       chan m.ProbeReadyPayload
+	shutdown        chan struct{}
+	jobScheduler    *scheduler.Scheduler
+	connectDeadline time.Duration
+	// backoff used between reconnects after the controller emits an error.
+	errorBackoff      *backoff.Backoff
+	assignmentsFile   string
+	assignmentsMaxAge time.Duration
+
+	version          string
+	statusInterval   time.Duration
+	failbackInterval time.Duration
+}
+
+// endpoint is one of the controller servers the probe can connect to.
+type endpoint struct {
+	url       *url.URL
+	connected *stats.Gauge32
 }
 
 func NewController(cfg *ControllerConfig) *Controller {
-	controllerURL, err := url.Parse(cfg.ServerAddr)
-	if err != nil {
-		log.Fatalf("unable to parse server-url: %s", err)
+	var endpoints []*endpoint
+	for _, addr := range strings.Split(cfg.ServerAddr, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		controllerURL, err := url.Parse(addr)
+		if err != nil {
+			log.Fatalf("unable to parse server-url: %s", err)
+		}
+		if controllerURL.Scheme != "ws" && controllerURL.Scheme != "wss" {
+			log.Fatalf("invalid server-url.  scheme must be ws or wss. was %s", controllerURL.Scheme)
+		}
+
+		controllerURL.Path = path.Clean(controllerURL.Path + "/socket.io")
+		controllerURL.RawQuery = fmt.Sprintf("EIO=3&transport=websocket&apiKey=%s&name=%s&version=%s", url.QueryEscape(cfg.ApiKey), url.QueryEscape(cfg.NodeName), url.QueryEscape(cfg.Version))
+		endpoints = append(endpoints, &endpoint{
+			url:       controllerURL,
+			connected: stats.NewGauge32(fmt.Sprintf("controller.endpoint.%d.connected", len(endpoints))),
+		})
 	}
-	if controllerURL.Scheme != "ws" && controllerURL.Scheme != "wss" {
-		log.Fatalf("invalid server-url.  scheme must be ws or wss. was %s", controllerURL.Scheme)
+	if len(endpoints) == 0 {
+		log.Fatal("no server-url set")
 	}
 
-	controllerURL.Path = path.Clean(controllerURL.Path + "/socket.io")
-	controllerURL.RawQuery = fmt.Sprintf("EIO=3&transport=websocket&apiKey=%s&name=%s&version=%s", url.QueryEscape(cfg.ApiKey), url.QueryEscape(cfg.NodeName), url.QueryEscape(cfg.Version))
-
 	c := &Controller{
-		URL:          controllerURL,
-		jobScheduler: cfg.JobScheduler,
-		shutdown:     make(chan struct{}),
-		readyChan:    make(chan m.ProbeReadyPayload),
+		endpoints:       endpoints,
+		jobScheduler:    cfg.JobScheduler,
+		shutdown:        make(chan struct{}),
+		readyChan:       make(chan m.ProbeReadyPayload),
+		connectDeadline: cfg.ConnectDeadline,
+		errorBackoff: &backoff.Backoff{
+			Min:    time.Second,
+			Max:    time.Minute * 5,
+			Factor: 2,
+			Jitter: true,
+		},
+		assignmentsFile:   cfg.AssignmentsFile,
+		assignmentsMaxAge: cfg.AssignmentsMaxAge,
+
+		version:          cfg.Version,
+		statusInterval:   cfg.StatusInterval,
+		failbackInterval: cfg.FailbackInterval,
+	}
+	if c.assignmentsFile != "" {
+		c.seedScheduler()
 	}
 	go c.loop(true)
 	return c
@@ -68,17 +187,18 @@ func (c *Controller) Stop() {
 	close(c.shutdown)
 }
 
-// Address returns the full URL of the controller server, minus the apiKey
+// Address returns the full URL of the current controller server, minus the apiKey
 func (c *Controller) Address() string {
-	u, _ := url.Parse(c.URL.String())
+	u, _ := url.Parse(c.endpoints[c.current].url.String())
 	queryParams := u.Query()
 	queryParams.Del("apiKey")
 	u.RawQuery = queryParams.Encode()
 	return u.String()
 }
 
-// core control loop.
-func (c *Controller) loop(panicOnConnectionFailure bool) {
+// core control loop. When initialConnect is true and a ConnectDeadline is set, the
+// process exits if no connection can be made before the deadline.
+func (c *Controller) loop(initialConnect bool) {
 	// use a mutex to ensure only one instance of the loop is running
 	c.Lock()
 	defer c.Unlock()
@@ -99,27 +219,58 @@ func (c *Controller) loop(panicOnConnectionFailure bool) {
 		Factor: 2,
 		Jitter: true,
 	}
+	start := time.Now()
+	first := c.current
 	for !connected {
-		client, err = gosocketio.Dial(c.URL.String(), wsTransport)
+		client, err = gosocketio.Dial(c.endpoints[c.current].url.String(), wsTransport)
 		if err != nil {
-			log.Errorf("failed to connect to controller. %s", err)
-			if panicOnConnectionFailure {
-				log.Fatalf("unable to connect to controller on url %s: %s", c.Address(), err)
-			} else {
-				log.Errorf("failed to connect to controller. %s", err)
-				time.Sleep(b.Duration())
+			if initialConnect && c.connectDeadline > 0 && time.Since(start) > c.connectDeadline {
+				log.Fatalf("unable to connect to controller on url %s within %s: %s", c.Address(), c.connectDeadline, err)
+			}
+			log.Errorf("failed to connect to controller at %s. %s", c.Address(), err)
+			c.next()
+			if c.current != first {
+				log.Infof("attempting to connect to controller at %s", c.Address())
+				continue
+			}
+			// every endpoint has failed, so wait before starting again.
+			dur := b.Duration()
+			log.Errorf("unable to connect to any controller. will try again in %s", dur)
+			select {
+			case <-c.shutdown:
+				log.Info("controller loop exiting")
+				return
+			case <-time.After(dur):
 			}
 		} else {
 			connected = true
 			controllerConnected.Set(1)
-			log.Info("Connected to controller")
+			log.Infof("Connected to controller at %s", c.Address())
 		}
 	}
+	ep := c.endpoints[c.current]
+	ep.connected.Set(1)
+	defer ep.connected.Set(0)
+
+	// when connected to a secondary controller, periodically try the primary.
+	var failback <-chan time.Time
+	if c.current != 0 && c.failbackInterval > 0 {
+		failbackTimer := time.NewTimer(c.failbackInterval)
+		defer failbackTimer.Stop()
+		failback = failbackTimer.C
+	}
 	// create a dedicated channel for this instance of the control loop.
 	// when this function ends, we drain and close the channel
 	eventChan := make(chan string, 2)
 	defer drainEventChan(eventChan)
-	c.bindHandlers(client, eventChan)
+	sess := &session{done: make(chan struct{})}
+	defer close(sess.done)
+	c.bindHandlers(client, eventChan, sess)
+	if c.statusInterval > 0 {
+		statusDone := make(chan struct{})
+		defer close(statusDone)
+		go c.emitStatus(client, statusDone)
+	}
 
 	maxInactivity := time.Minute * 30
 	timer := time.NewTimer(maxInactivity)
@@ -139,25 +290,60 @@ func (c *Controller) loop(panicOnConnectionFailure bool) {
 				// once closed, a "disconnected" event will be emitted,
 				// but we can just ignore it.
 			}
+			c.next()
+			go c.loop(false)
+			return
+		case <-failback:
+			log.Infof("failing back to primary controller")
+			if client.IsAlive() {
+				client.Close()
+			}
+			c.current = 0
 			go c.loop(false)
 			return
 		case event := <-eventChan:
 			switch event {
 			case "disconnected":
+				c.next()
 				go c.loop(false)
 				return
 			case "refresh":
 				log.Debug("refresh event received on eventChan")
+				c.errorBackoff.Reset()
+			case "error":
+				if client.IsAlive() {
+					log.Info("closing connection to controller")
+					client.Close()
+				}
+				dur := c.errorBackoff.Duration()
+				log.Infof("reconnecting to controller in %s", dur)
+				select {
+				case <-c.shutdown:
+					log.Info("controller loop exiting")
+					return
+				case <-time.After(dur):
+				}
+				c.next()
+				go c.loop(false)
+				return
 			}
 		case event := <-c.readyChan:
 			log.Infof("server sent ready event. ProbeId=%d", event.Collector.Id)
 			probe.Self = event.Collector
+			sess.Lock()
+			sess.ready = true
+			pending := sess.pending
+			sess.pending = nil
+			sess.Unlock()
+			if pending != nil {
+				c.saveAssignments(pending)
+			}
 
-			// update c.URL so next time we connect we pass our current socketID as
+			// update the endpoint URL so next time we connect we pass our current socketID as
 			// lastSocketId query param
-			queryParams := c.URL.Query()
+			queryParams := ep.url.Query()
 			queryParams["lastSocketId"] = []string{event.SocketId}
-			c.URL.RawQuery = queryParams.Encode()
+			ep.url.RawQuery = queryParams.Encode()
 		}
 		if !timer.Stop() {
 			<-timer.C
@@ -166,7 +352,13 @@ func (c *Controller) loop(panicOnConnectionFailure bool) {
 	}
 }
 
-func (c *Controller) bindHandlers(client *gosocketio.Client, eventChan chan string) {
+// next moves to the next controller endpoint, in priority order. The caller
+// must hold the lock.
+func (c *Controller) next() {
+	c.current = (c.current + 1) % len(c.endpoints)
+}
+
+func (c *Controller) bindHandlers(client *gosocketio.Client, eventChan chan string, sess *session) {
 	if !client.IsAlive() {
 		log.Error("Connection to controller closed before binding handlers.")
 		eventChan <- "disconnected"
@@ -181,6 +373,15 @@ func (c *Controller) bindHandlers(client *gosocketio.Client, eventChan chan stri
 		eventsReceived.Inc()
 		eventChan <- "refresh"
 		c.jobScheduler.Refresh(checks)
+		sess.Lock()
+		ready := sess.ready
+		if !ready {
+			sess.pending = checks
+		}
+		sess.Unlock()
+		if ready {
+			c.saveAssignments(checks)
+		}
 	})
 	client.On("created", func(gsc *gosocketio.Channel, check m.CheckWithSlug) {
 		eventsReceived.Inc()
@@ -200,7 +401,21 @@ func (c *Controller) bindHandlers(client *gosocketio.Client, eventChan chan stri
 	})
 	client.On("error", func(gsc *gosocketio.Channel, reason string) {
 		eventsReceived.Inc()
-		log.Fatalf("Controller emitted an error. %s", reason)
+		if !sess.isReady() && isFatalControllerError(reason) {
+			log.Fatalf("Controller emitted an error. %s", reason)
+		}
+		// the checks that are already scheduled keep running while we reconnect.
+		log.Errorf("Controller emitted an error, will reconnect. %s", reason)
+		// once the loop has moved on, eventChan is closed by drainEventChan.
+		select {
+		case <-sess.done:
+			return
+		default:
+		}
+		select {
+		case eventChan <- "error":
+		case <-sess.done:
+		}
 	})
 }
 
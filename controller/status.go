@@ -0,0 +1,64 @@
+package controller
+
+import (
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+	gosocketio "github.com/gsocket-io/golang-socketio"
+	"github.com/raintank/raintank-probe/publisher"
+	"github.com/raintank/raintank-probe/scheduler"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	startTime = time.Now()
+
+	statusSent = stats.NewCounterRate32("controller.status.sent")
+)
+
+// StatusPayload is emitted to the controller as a "status" event, so that the
+// server can see the health of the probe and any misconfigured checks.
+type StatusPayload struct {
+	Version string `json:"version"`
+	// seconds since the probe started.
+	Uptime    int64             `json:"uptime"`
+	Timestamp int64             `json:"timestamp"`
+	Scheduler scheduler.Status  `json:"scheduler"`
+	Backlog   publisher.Backlog `json:"backlog"`
+}
+
+func (c *Controller) status() StatusPayload {
+	now := time.Now()
+	payload := StatusPayload{
+		Version:   c.version,
+		Uptime:    int64(now.Sub(startTime).Seconds()),
+		Timestamp: now.Unix(),
+		Scheduler: c.jobScheduler.Status(),
+	}
+	if publisher.Publisher != nil {
+		payload.Backlog = publisher.Publisher.Backlog()
+	}
+	return payload
+}
+
+// emitStatus sends the status to the controller every statusInterval until
+// done is closed.
+func (c *Controller) emitStatus(client *gosocketio.Client, done chan struct{}) {
+	ticker := time.NewTicker(c.statusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if !client.IsAlive() {
+				continue
+			}
+			if err := client.Emit("status", c.status()); err != nil {
+				log.Warnf("unable to send status to controller. %s", err)
+				continue
+			}
+			statusSent.Inc()
+		}
+	}
+}
@@ -1,13 +1,13 @@
 module github.com/raintank/raintank-probe
 
-go 1.12
+go 1.13
 
 require (
 	github.com/Dieterbe/artisanalhistogram v0.0.0-20170619072513-f61b7225d304 // indirect
 	github.com/cespare/xxhash v1.1.1-0.20190104011926-30d0e5bcb75d // indirect
 	github.com/dgryski/go-jump v0.0.0-20170409065014-e1f439676b57 // indirect
 	github.com/dgryski/go-linlog v0.0.0-20180207191225-edcf2dfd90ff // indirect
-	github.com/glacjay/goini v0.0.0-20161120062552-fd3024d87ee2 // indirect
+	github.com/glacjay/goini v0.0.0-20161120062552-fd3024d87ee2
 	github.com/golang/snappy v0.0.0-20170215233205-553a64147049
 	github.com/gorilla/websocket v0.0.0-20171210035353-cdedf21e585d
 	github.com/grafana/grafana v6.1.6+incompatible // indirect
@@ -1,6 +1,7 @@
 package healthz
 
 import (
+	"encoding/json"
 	"net/http"
 	"time"
 
@@ -14,7 +15,8 @@ type Healthz struct {
 }
 
 // NewHealthz runs a HTTP server, accepting requests to /ready and /alive which reports the
-// readiness/liveness of the probe
+// readiness/liveness of the probe, and /health which reports the result of the last health
+// evaluation of each health target
 func NewHealthz(jobScheduler *scheduler.Scheduler, addr string) *Healthz {
 	h := Healthz{
 		jobScheduler: jobScheduler,
@@ -23,6 +25,7 @@ func NewHealthz(jobScheduler *scheduler.Scheduler, addr string) *Healthz {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/ready", h.ReadyHandler())
 	mux.HandleFunc("/alive", h.AliveHandler())
+	mux.HandleFunc("/health", h.HealthHandler())
 	s := &http.Server{
 		Addr:         addr,
 		Handler:      mux,
@@ -63,3 +66,18 @@ func (h *Healthz) AliveHandler() http.HandlerFunc {
 		w.Write([]byte("OK"))
 	}
 }
+
+func (h *Healthz) HealthHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		health := h.jobScheduler.Health()
+		w.Header().Set("Content-Type", "application/json")
+		if health.Healthy {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(health); err != nil {
+			log.Errorf("healthz: unable to encode response. %s", err)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package publisher
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// writeError describes a failed request to tsdb-gw and whether it
+// is worth retrying.
+type writeError struct {
+	statusCode int
+	body       string
+	err        error
+	permanent  bool
+	retryAfter time.Duration
+}
+
+func (e *writeError) Error() string {
+	if e.err != nil {
+		return e.err.Error()
+	}
+	return fmt.Sprintf("http %d - %s", e.statusCode, e.body)
+}
+
+// newWriteError classifies the outcome of a request. Network errors, 5xx, 408
+// and 429 responses are retryable, all other responses are permanent failures.
+func newWriteError(resp *http.Response, err error) *writeError {
+	if err != nil {
+		return &writeError{err: err}
+	}
+	buf := make([]byte, 300)
+	n, _ := resp.Body.Read(buf)
+	resp.Body.Close()
+	e := &writeError{
+		statusCode: resp.StatusCode,
+		body:       string(buf[:n]),
+		retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+	switch {
+	case resp.StatusCode >= 500:
+	case resp.StatusCode == http.StatusTooManyRequests:
+	case resp.StatusCode == http.StatusRequestTimeout:
+	default:
+		e.permanent = true
+	}
+	return e
+}
+
+// isTooLarge returns true if tsdb-gw rejected the request because the body was too big.
+func isTooLarge(err error) bool {
+	wErr, ok := err.(*writeError)
+	return ok && wErr.statusCode == http.StatusRequestEntityTooLarge
+}
+
+// longest delay requested by a Retry-After header that is honoured. Longer
+// delays are capped, so a misbehaving server can not stall the publisher.
+const maxRetryAfter = time.Minute
+
+// parseRetryAfter parses the value of a Retry-After header, which is either
+// a number of seconds or a HTTP date. The result is capped at maxRetryAfter.
+func parseRetryAfter(value string) time.Duration {
+	d := parseRetryAfterValue(value)
+	if d > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return d
+}
+
+func parseRetryAfterValue(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if ts, err := http.ParseTime(value); err == nil {
+		return time.Until(ts)
+	}
+	return 0
+}
+
+// deadLetter appends batches that could not be delivered to a file, one
+// JSON document per line.
+type deadLetter struct {
+	sync.Mutex
+	path string
+}
+
+type deadLetterRecord struct {
+	Timestamp int64       `json:"timestamp"`
+	Kind      string      `json:"kind"`
+	Error     string      `json:"error"`
+	Data      interface{} `json:"data"`
+}
+
+func newDeadLetter(path string) *deadLetter {
+	return &deadLetter{path: path}
+}
+
+func (d *deadLetter) Write(kind string, err error, data interface{}) {
+	record := deadLetterRecord{
+		Timestamp: time.Now().Unix(),
+		Kind:      kind,
+		Error:     err.Error(),
+		Data:      data,
+	}
+	line, jErr := json.Marshal(record)
+	if jErr != nil {
+		log.Errorf("unable to encode dead-letter record. %s", jErr)
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+	f, fErr := os.OpenFile(d.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if fErr != nil {
+		log.Errorf("unable to open dead-letter file %s. %s", d.path, fErr)
+		return
+	}
+	defer f.Close()
+	if _, fErr = f.Write(append(line, '\n')); fErr != nil {
+		log.Errorf("unable to write to dead-letter file %s. %s", d.path, fErr)
+	}
+}
@@ -0,0 +1,231 @@
+package publisher
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/schema"
+	"github.com/grafana/metrictank/stats"
+	eventMsg "github.com/grafana/worldping-gw/msg"
+	m "github.com/raintank/worldping-api/pkg/models"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	jsonlRecordsWritten = stats.NewCounterRate32("publisher.jsonl.written")
+	jsonlRecordsDropped = stats.NewCounterRate32("publisher.jsonl.dropped")
+)
+
+// JsonlRecord is a single line written by the JSONL sink.
+type JsonlRecord struct {
+	// either "result" or "event"
+	Kind      string               `json:"kind"`
+	CheckId   int64                `json:"checkId"`
+	OrgId     int64                `json:"orgId"`
+	Slug      string               `json:"endpointSlug"`
+	Type      m.CheckType          `json:"type"`
+	Timestamp int64                `json:"timestamp"`
+	Result    interface{}          `json:"result,omitempty"`
+	Event     *eventMsg.ProbeEvent `json:"event,omitempty"`
+}
+
+type JsonlConfig struct {
+	// path of the file to write to. "-" writes to stdout.
+	Path string
+	// size in bytes at which the file is rotated. 0 disables rotation.
+	MaxSize int64
+	// number of rotated files to keep.
+	MaxBackups int
+}
+
+// Jsonl is a Sink that writes every check result and event as a JSON
+// document per line to a local file or stdout. Metrics are not written.
+type Jsonl struct {
+	cfg      JsonlConfig
+	records  chan *JsonlRecord
+	file     *os.File
+	writer   *bufio.Writer
+	size     int64
+	shutdown chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewJsonl(cfg JsonlConfig) (*Jsonl, error) {
+	j := &Jsonl{
+		cfg:      cfg,
+		records:  make(chan *JsonlRecord, 50000),
+		shutdown: make(chan struct{}),
+	}
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+	j.wg.Add(1)
+	go j.run()
+	return j, nil
+}
+
+func (j *Jsonl) Add(metrics []*schema.MetricData) {}
+
+func (j *Jsonl) AddEvent(check *m.CheckWithSlug, event *eventMsg.ProbeEvent) {
+	record := &JsonlRecord{
+		Kind:      "event",
+		OrgId:     event.OrgId,
+		Timestamp: event.Timestamp,
+		Event:     event,
+	}
+	if check != nil {
+		record.CheckId = check.Id
+		record.Slug = check.Slug
+		record.Type = check.Type
+	}
+	j.add(record)
+}
+
+func (j *Jsonl) AddResult(check *m.CheckWithSlug, t time.Time, result interface{}) {
+	j.add(&JsonlRecord{
+		Kind:      "result",
+		CheckId:   check.Id,
+		OrgId:     check.OrgId,
+		Slug:      check.Slug,
+		Type:      check.Type,
+		Timestamp: t.UnixNano() / int64(time.Millisecond),
+		Result:    result,
+	})
+}
+
+func (j *Jsonl) add(record *JsonlRecord) {
+	// never block the check execution on the local sink.
+	select {
+	case j.records <- record:
+	default:
+		jsonlRecordsDropped.Inc()
+	}
+}
+
+func (j *Jsonl) Backlog() Backlog {
+	return Backlog{Records: len(j.records)}
+}
+
+func (j *Jsonl) Stop() {
+	close(j.shutdown)
+	j.wg.Wait()
+	log.Info("jsonl sink stopped")
+}
+
+func (j *Jsonl) run() {
+	defer j.wg.Done()
+	ticker := time.NewTicker(maxFlushWait)
+	defer ticker.Stop()
+	for {
+		select {
+		case record := <-j.records:
+			j.write(record)
+		case <-ticker.C:
+			j.writer.Flush()
+		case <-j.shutdown:
+			for {
+				select {
+				case record := <-j.records:
+					j.write(record)
+				default:
+					j.close()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (j *Jsonl) write(record *JsonlRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Errorf("unable to encode jsonl record. %s", err)
+		jsonlRecordsDropped.Inc()
+		return
+	}
+	line = append(line, '\n')
+	if j.cfg.MaxSize > 0 && j.size+int64(len(line)) > j.cfg.MaxSize {
+		if err := j.rotate(); err != nil {
+			log.Errorf("unable to rotate %s. %s", j.cfg.Path, err)
+		}
+	}
+	n, err := j.writer.Write(line)
+	j.size += int64(n)
+	if err != nil {
+		log.Errorf("unable to write to %s. %s", j.cfg.Path, err)
+		jsonlRecordsDropped.Inc()
+		return
+	}
+	jsonlRecordsWritten.Inc()
+}
+
+func (j *Jsonl) open() error {
+	if j.cfg.Path == "-" {
+		j.writer = bufio.NewWriter(os.Stdout)
+		return nil
+	}
+	f, err := os.OpenFile(j.cfg.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	j.file = f
+	j.size = info.Size()
+	j.writer = bufio.NewWriter(f)
+	return nil
+}
+
+func (j *Jsonl) close() {
+	j.writer.Flush()
+	if j.file != nil {
+		j.file.Close()
+	}
+}
+
+// rotate moves the current file to path.1, shifting older files up to
+// MaxBackups, and opens a new file. The current file is only closed once the
+// new file is open, so on any error records keep being written to it.
+func (j *Jsonl) rotate() error {
+	if j.file == nil {
+		// stdout is never rotated.
+		return nil
+	}
+	if err := j.writer.Flush(); err != nil {
+		return err
+	}
+	if j.cfg.MaxBackups == 0 {
+		if err := j.file.Truncate(0); err != nil {
+			j.size = 0
+			return err
+		}
+		j.size = 0
+		return nil
+	}
+	for i := j.cfg.MaxBackups; i > 0; i-- {
+		src := j.cfg.Path
+		if i > 1 {
+			src = fmt.Sprintf("%s.%d", j.cfg.Path, i-1)
+		}
+		err := os.Rename(src, fmt.Sprintf("%s.%d", j.cfg.Path, i))
+		if err != nil && !os.IsNotExist(err) {
+			// wait for another MaxSize to be written before trying again.
+			j.size = 0
+			return err
+		}
+	}
+	current := j.file
+	if err := j.open(); err != nil {
+		j.size = 0
+		return err
+	}
+	current.Close()
+	return nil
+}
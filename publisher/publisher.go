@@ -2,9 +2,9 @@ package publisher
 
 import (
 	"bytes"
-	"crypto/tls"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
-	"net"
 	"net/http"
 	"net/url"
 	"strings"
@@ -17,93 +17,190 @@ import (
 	"github.com/grafana/metrictank/stats"
 	eventMsg "github.com/grafana/worldping-gw/msg"
 	"github.com/jpillora/backoff"
+	m "github.com/raintank/worldping-api/pkg/models"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
-	Publisher          *Tsdb
+	Publisher          Sink
 	maxMetricsPerFlush = 10000
 	maxEventsPerFlush  = 10000
 	maxFlushWait       = time.Millisecond * 500
 
-	publisherEventsSent  = stats.NewCounterRate32("publisher.events.sent")
-	publisherMetricsSent = stats.NewCounterRate32("publisher.metrics.sent")
+	publisherEventsSent     = stats.NewCounterRate32("publisher.events.sent")
+	publisherMetricsSent    = stats.NewCounterRate32("publisher.metrics.sent")
+	publisherEventsDropped  = stats.NewCounterRate32("publisher.events.dropped")
+	publisherMetricsDropped = stats.NewCounterRate32("publisher.metrics.dropped")
 )
 
-func Init(u *url.URL, apiKey string, concurrency int) {
-	Publisher = NewTsdb(u, apiKey, concurrency)
+type TsdbConfig struct {
+	Url         *url.URL
+	ApiKey      string
+	Concurrency int
+	Transport   TransportConfig
+
+	// maximum number of attempts to make for a batch that fails with a
+	// retryable error, and how long to keep retrying it for. 0 means no limit.
+	MaxRetries   int
+	MaxRetryTime time.Duration
+	// file to append batches to when they can not be delivered. If empty,
+	// undeliverable batches are dropped.
+	DeadLetterFile string
+}
+
+// Sink is a destination for the metrics, events and raw results produced by checks.
+type Sink interface {
+	Add(metrics []*schema.MetricData)
+	// AddEvent publishes an event. check is nil for events that are not
+	// related to a specific check.
+	AddEvent(check *m.CheckWithSlug, event *eventMsg.ProbeEvent)
+	AddResult(check *m.CheckWithSlug, t time.Time, result interface{})
+	// Backlog returns the amount of data waiting to be written.
+	Backlog() Backlog
+	Stop()
+}
+
+// Backlog is the amount of data buffered by a sink that has not yet been written.
+type Backlog struct {
+	// metrics and events waiting to be added to a batch.
+	Metrics int `json:"metrics"`
+	Events  int `json:"events"`
+	// batches waiting to be sent.
+	Batches int `json:"batches"`
+	// records waiting to be written to a local file.
+	Records int `json:"records"`
+}
+
+func (b Backlog) add(o Backlog) Backlog {
+	b.Metrics += o.Metrics
+	b.Events += o.Events
+	b.Batches += o.Batches
+	b.Records += o.Records
+	return b
+}
+
+// Init sets the Publisher to send to all of the passed sinks.
+func Init(sinks ...Sink) {
+	if len(sinks) == 1 {
+		Publisher = sinks[0]
+		return
+	}
+	Publisher = multiSink(sinks)
 }
 
 func Stop() {
 	Publisher.Stop()
 }
 
+// multiSink fans out everything published to a list of sinks.
+type multiSink []Sink
+
+func (ms multiSink) Add(metrics []*schema.MetricData) {
+	for _, s := range ms {
+		s.Add(metrics)
+	}
+}
+
+func (ms multiSink) AddEvent(check *m.CheckWithSlug, event *eventMsg.ProbeEvent) {
+	for _, s := range ms {
+		s.AddEvent(check, event)
+	}
+}
+
+func (ms multiSink) AddResult(check *m.CheckWithSlug, t time.Time, result interface{}) {
+	for _, s := range ms {
+		s.AddResult(check, t, result)
+	}
+}
+
+func (ms multiSink) Backlog() Backlog {
+	b := Backlog{}
+	for _, s := range ms {
+		b = b.add(s.Backlog())
+	}
+	return b
+}
+
+func (ms multiSink) Stop() {
+	for _, s := range ms {
+		s.Stop()
+	}
+}
+
 type Tsdb struct {
 	sync.Mutex
 	concurrency        int
 	tsdbUrl            string
 	tsdbKey            string
-	metricsWriteQueues []chan []byte
-	eventsWriteQueue   chan []byte
+	metricsWriteQueues []chan []*schema.MetricData
+	eventsWriteQueue   chan []*eventMsg.ProbeEvent
 	shutdown           chan struct{}
 	wg                 *sync.WaitGroup
 	metricsIn          chan *schema.MetricData
 	eventsIn           chan *eventMsg.ProbeEvent
 	client             *http.Client
+	maxRetries         int
+	maxRetryTime       time.Duration
+	deadLetter         *deadLetter
 }
 
-func NewTsdb(u *url.URL, apiKey string, concurrency int) *Tsdb {
-	tsdbUrl := strings.TrimSuffix(u.String(), "/")
+func NewTsdb(cfg *TsdbConfig) (*Tsdb, error) {
+	client, err := cfg.Transport.NewClient()
+	if err != nil {
+		return nil, err
+	}
+	concurrency := cfg.Concurrency
+	tsdbUrl := strings.TrimSuffix(cfg.Url.String(), "/")
 	t := &Tsdb{
 		tsdbUrl:            tsdbUrl,
-		tsdbKey:            apiKey,
+		tsdbKey:            cfg.ApiKey,
 		concurrency:        concurrency,
-		metricsWriteQueues: make([]chan []byte, concurrency),
-		eventsWriteQueue:   make(chan []byte, concurrency),
+		metricsWriteQueues: make([]chan []*schema.MetricData, concurrency),
+		eventsWriteQueue:   make(chan []*eventMsg.ProbeEvent, concurrency),
 		shutdown:           make(chan struct{}),
 		metricsIn:          make(chan *schema.MetricData, 1000000),
 		eventsIn:           make(chan *eventMsg.ProbeEvent, 50000),
 		wg:                 &sync.WaitGroup{},
+		client:             client,
+		maxRetries:         cfg.MaxRetries,
+		maxRetryTime:       cfg.MaxRetryTime,
 	}
-	for i := 0; i < concurrency; i++ {
-		t.metricsWriteQueues[i] = make(chan []byte, 100)
-	}
-	// start off with a transport the same as Go's DefaultTransport
-	transport := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-			DualStack: true,
-		}).DialContext,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
+	if cfg.DeadLetterFile != "" {
+		t.deadLetter = newDeadLetter(cfg.DeadLetterFile)
 	}
-	// disable http 2.0 because there seems to be a compatibility problem between nginx hosts and the golang http2 implementation
-	// which would occasionally result in bogus `400 Bad Request` errors.
-	transport.TLSNextProto = make(map[string]func(authority string, c *tls.Conn) http.RoundTripper)
-
-	t.client = &http.Client{
-		Timeout: time.Second * 10,
+	for i := 0; i < concurrency; i++ {
+		t.metricsWriteQueues[i] = make(chan []*schema.MetricData, 100)
 	}
-	//t.client.Transport = transport
 	go t.run()
-	return t
+	return t, nil
 }
 
 // Add metrics to the input buffer
 func (t *Tsdb) Add(metrics []*schema.MetricData) {
-	for _, m := range metrics {
-		t.metricsIn <- m
+	for _, md := range metrics {
+		t.metricsIn <- md
 	}
 }
 
-func (t *Tsdb) AddEvent(event *eventMsg.ProbeEvent) {
+func (t *Tsdb) AddEvent(check *m.CheckWithSlug, event *eventMsg.ProbeEvent) {
 	t.eventsIn <- event
 }
 
+// AddResult is a no-op, tsdb-gw only receives metrics and events.
+func (t *Tsdb) AddResult(check *m.CheckWithSlug, ts time.Time, result interface{}) {}
+
+func (t *Tsdb) Backlog() Backlog {
+	b := Backlog{
+		Metrics: len(t.metricsIn),
+		Events:  len(t.eventsIn),
+		Batches: len(t.eventsWriteQueue),
+	}
+	for _, q := range t.metricsWriteQueues {
+		b.Batches += len(q)
+	}
+	return b
+}
+
 func (t *Tsdb) run() {
 	metrics := make([][]*schema.MetricData, t.concurrency)
 	events := make([]*eventMsg.ProbeEvent, 0, maxEventsPerFlush)
@@ -124,27 +221,19 @@ func (t *Tsdb) run() {
 		if len(metrics[shard]) == 0 {
 			return
 		}
-		mda := schema.MetricDataArray(metrics[shard])
-		data, err := msg.CreateMsg(mda, 0, msg.FormatMetricDataArrayMsgp)
-		if err != nil {
-			panic(err)
-		}
-		t.metricsWriteQueues[shard] <- data
+		t.metricsWriteQueues[shard] <- metrics[shard]
 		publisherMetricsSent.Add(len(metrics[shard]))
-		metrics[shard] = metrics[shard][:0]
+		// the batch is now owned by the write queue, so start a new buffer.
+		metrics[shard] = make([]*schema.MetricData, 0, maxMetricsPerFlush)
 	}
 
 	flushEvents := func() {
 		if len(events) == 0 {
 			return
 		}
-		data, err := eventMsg.CreateProbeEventsMsg(events)
-		if err != nil {
-			panic(err)
-		}
-		t.eventsWriteQueue <- data
+		t.eventsWriteQueue <- events
 		publisherEventsSent.Add(len(events))
-		events = events[:0]
+		events = make([]*eventMsg.ProbeEvent, 0, maxEventsPerFlush)
 	}
 
 	ticker := time.NewTicker(maxFlushWait)
@@ -206,43 +295,33 @@ func (t *Tsdb) flushMetrics(shard int) {
 		Factor: 1.5,
 		Jitter: true,
 	}
-	body := new(bytes.Buffer)
-	var bodyLen int
 	defer t.wg.Done()
-	for data := range q {
-		for {
-			pre := time.Now()
-			body.Reset()
-			snappyBody := snappy.NewWriter(body)
-			snappyBody.Write(data)
-			bodyLen = body.Len()
-			req, err := http.NewRequest("POST", t.tsdbUrl+"/metrics", body)
-			if err != nil {
-				panic(err)
-			}
-			req.Header.Add("Authorization", "Bearer "+t.tsdbKey)
-			req.Header.Add("Content-Type", "rt-metric-binary-snappy")
-			resp, err := t.client.Do(req)
-			diff := time.Since(pre)
-			if err == nil && resp.StatusCode >= 200 && resp.StatusCode < 300 {
-				b.Reset()
-				log.Debugf("GrafanaNet sent metrics in %s -msg size %d", diff, bodyLen)
-				resp.Body.Close()
-				ioutil.ReadAll(resp.Body)
-				break
-			}
-			dur := b.Duration()
-			if err != nil {
-				log.Warningf("GrafanaNet failed to submit metrics: %s will try again in %s (this attempt took %s)", err, dur, diff)
-			} else {
-				buf := make([]byte, 300)
-				n, _ := resp.Body.Read(buf)
-				log.Warningf("GrafanaNet failed to submit metrics: http %d - %s will try again in %s (this attempt took %s)", resp.StatusCode, buf[:n], dur, diff)
-				resp.Body.Close()
-			}
+	for batch := range q {
+		t.writeMetrics(batch, b)
+	}
+}
 
-			time.Sleep(dur)
-		}
+func (t *Tsdb) writeMetrics(batch []*schema.MetricData, b *backoff.Backoff) {
+	data, err := msg.CreateMsg(schema.MetricDataArray(batch), 0, msg.FormatMetricDataArrayMsgp)
+	if err != nil {
+		panic(err)
+	}
+	err = t.write("/metrics", "metrics", data, b)
+	if err == nil {
+		return
+	}
+	if isTooLarge(err) && len(batch) > 1 {
+		half := len(batch) / 2
+		log.Warningf("GrafanaNet rejected batch of %d metrics as too large, splitting it in two.", len(batch))
+		t.writeMetrics(batch[:half], b)
+		t.writeMetrics(batch[half:], b)
+		return
+	}
+	publisherMetricsDropped.Add(len(batch))
+	sample, _ := json.Marshal(batch[0])
+	log.Errorf("GrafanaNet failed to submit metrics: %s. dropping %d metrics, sample: %s", err, len(batch), sample)
+	if t.deadLetter != nil {
+		t.deadLetter.Write("metrics", err, batch)
 	}
 }
 
@@ -254,42 +333,85 @@ func (t *Tsdb) flushEvents() {
 		Factor: 1.5,
 		Jitter: true,
 	}
-	body := new(bytes.Buffer)
-	var bodyLen int
 	defer t.wg.Done()
-	for data := range q {
-		for {
-			pre := time.Now()
-			body.Reset()
-			snappyBody := snappy.NewWriter(body)
-			snappyBody.Write(data)
-			bodyLen = body.Len()
-			req, err := http.NewRequest("POST", t.tsdbUrl+"/events", body)
-			if err != nil {
-				panic(err)
-			}
-			req.Header.Add("Authorization", "Bearer "+t.tsdbKey)
-			req.Header.Add("Content-Type", "rt-metric-binary-snappy")
-			resp, err := t.client.Do(req)
-			diff := time.Since(pre)
-			if err == nil && resp.StatusCode >= 200 && resp.StatusCode < 300 {
-				b.Reset()
-				log.Debugf("GrafanaNet sent event in %s -msg size %d", diff, bodyLen)
-				resp.Body.Close()
-				ioutil.ReadAll(resp.Body)
-				break
-			}
-			dur := b.Duration()
-			if err != nil {
-				log.Warningf("GrafanaNet failed to submit event: %s will try again in %s (this attempt took %s)", err, dur, diff)
-			} else {
-				buf := make([]byte, 300)
-				n, _ := resp.Body.Read(buf)
-				log.Warningf("GrafanaNet failed to submit event: http %d - %s will try again in %s (this attempt took %s)", resp.StatusCode, buf[:n], dur, diff)
-				resp.Body.Close()
-			}
+	for batch := range q {
+		t.writeEvents(batch, b)
+	}
+}
+
+func (t *Tsdb) writeEvents(batch []*eventMsg.ProbeEvent, b *backoff.Backoff) {
+	data, err := eventMsg.CreateProbeEventsMsg(batch)
+	if err != nil {
+		panic(err)
+	}
+	err = t.write("/events", "event", data, b)
+	if err == nil {
+		return
+	}
+	if isTooLarge(err) && len(batch) > 1 {
+		half := len(batch) / 2
+		log.Warningf("GrafanaNet rejected batch of %d events as too large, splitting it in two.", len(batch))
+		t.writeEvents(batch[:half], b)
+		t.writeEvents(batch[half:], b)
+		return
+	}
+	publisherEventsDropped.Add(len(batch))
+	sample, _ := json.Marshal(batch[0])
+	log.Errorf("GrafanaNet failed to submit events: %s. dropping %d events, sample: %s", err, len(batch), sample)
+	if t.deadLetter != nil {
+		t.deadLetter.Write("events", err, batch)
+	}
+}
 
-			time.Sleep(dur)
+// write POSTs data to tsdb-gw, retrying with backoff until the request succeeds,
+// fails with a permanent error, or maxRetries attempts have been made or
+// maxRetryTime has passed.
+func (t *Tsdb) write(path, desc string, data []byte, b *backoff.Backoff) error {
+	body := new(bytes.Buffer)
+	start := time.Now()
+	attempts := 0
+	for {
+		attempts++
+		pre := time.Now()
+		body.Reset()
+		snappyBody := snappy.NewWriter(body)
+		snappyBody.Write(data)
+		bodyLen := body.Len()
+		req, err := http.NewRequest("POST", t.tsdbUrl+path, body)
+		if err != nil {
+			panic(err)
+		}
+		req.Header.Add("Authorization", "Bearer "+t.tsdbKey)
+		req.Header.Add("Content-Type", "rt-metric-binary-snappy")
+		resp, err := t.client.Do(req)
+		diff := time.Since(pre)
+		if err == nil && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			b.Reset()
+			log.Debugf("GrafanaNet sent %s in %s -msg size %d", desc, diff, bodyLen)
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			return nil
 		}
+		wErr := newWriteError(resp, err)
+		// the next batch starts with a fresh backoff.
+		if wErr.permanent {
+			b.Reset()
+			return wErr
+		}
+		if t.maxRetries > 0 && attempts >= t.maxRetries {
+			b.Reset()
+			return fmt.Errorf("giving up after %d attempts. %s", attempts, wErr)
+		}
+		if t.maxRetryTime > 0 && time.Since(start) >= t.maxRetryTime {
+			b.Reset()
+			return fmt.Errorf("giving up after %d attempts in %s. %s", attempts, time.Since(start), wErr)
+		}
+		dur := b.Duration()
+		if wErr.retryAfter > 0 {
+			dur = wErr.retryAfter
+		}
+		log.Warningf("GrafanaNet failed to submit %s: %s will try again in %s (this attempt took %s)", desc, wErr, dur, diff)
+
+		time.Sleep(dur)
 	}
 }
@@ -0,0 +1,117 @@
+package publisher
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// TransportConfig holds the settings used to build the http client for
+// sending data to tsdb-gw.
+type TransportConfig struct {
+	// proxy to use. If empty, the proxy is taken from the HTTP_PROXY/HTTPS_PROXY
+	// environment variables.
+	ProxyURL string
+
+	// timeout for an entire request, including reading the response.
+	Timeout               time.Duration
+	DialTimeout           time.Duration
+	KeepAlive             time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+
+	// HTTP2 is disabled by default as there seems to be a compatibility problem
+	// between nginx hosts and the golang http2 implementation which would
+	// occasionally result in bogus `400 Bad Request` errors.
+	EnableHTTP2 bool
+
+	// PEM encoded CA bundle used to verify the tsdb-gw certificate. If empty
+	// the system roots are used.
+	CACertFile string
+	// PEM encoded client certificate and key for mTLS to the gateway.
+	ClientCertFile string
+	ClientKeyFile  string
+	// skip verification of the tsdb-gw certificate.
+	InsecureSkipVerify bool
+}
+
+// NewClient builds the http.Client described by the TransportConfig.
+func (c TransportConfig) NewClient() (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if c.ProxyURL != "" {
+		proxyURL, err := url.Parse(c.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url. %s", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   c.DialTimeout,
+			KeepAlive: c.KeepAlive,
+			DualStack: true,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		MaxIdleConns:          c.MaxIdleConns,
+		MaxIdleConnsPerHost:   c.MaxIdleConnsPerHost,
+		IdleConnTimeout:       c.IdleConnTimeout,
+		TLSHandshakeTimeout:   c.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: c.ResponseHeaderTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if c.EnableHTTP2 {
+		// we set a custom TLSClientConfig and DialContext, so http2 needs to be
+		// explicitly requested.
+		transport.ForceAttemptHTTP2 = true
+	} else {
+		transport.TLSNextProto = make(map[string]func(authority string, c *tls.Conn) http.RoundTripper)
+	}
+
+	return &http.Client{
+		Timeout:   c.Timeout,
+		Transport: transport,
+	}, nil
+}
+
+func (c TransportConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CACertFile != "" {
+		pem, err := ioutil.ReadFile(c.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA cert file. %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no valid certificates found in %s", c.CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.ClientCertFile != "" || c.ClientKeyFile != "" {
+		if c.ClientCertFile == "" || c.ClientKeyFile == "" {
+			return nil, fmt.Errorf("both a client cert and client key must be provided for mTLS")
+		}
+		cert, err := tls.LoadX509KeyPair(c.ClientCertFile, c.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate. %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,88 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/raintank-probe/checks"
+	m "github.com/raintank/worldping-api/pkg/models"
+)
+
+var schedulerChecksCoalesced = stats.NewCounterRate32("scheduler.checks.coalesced")
+
+// settings that only affect how the scheduler handles a result, not how the
+// check is executed. They are ignored when matching identical checks.
+var schedulerSettings = []string{"warnThresholds", "overrun"}
+
+// execCache shares a single execution between identical checks, of the same
+// type and with the same settings, that run in the same tick. Each check then
+// builds its own metrics and events from the shared result.
+type execCache struct {
+	sync.Mutex
+	entries map[string]*execEntry
+}
+
+type execEntry struct {
+	done     chan struct{}
+	results  checks.CheckResult
+	attempts int
+	err      error
+}
+
+func newExecCache() *execCache {
+	return &execCache{
+		entries: make(map[string]*execEntry),
+	}
+}
+
+// coalesceKey returns the key identifying executions of the check in tick t
+// that can be shared.
+func coalesceKey(check *m.CheckWithSlug, t time.Time) (string, error) {
+	settings := make(map[string]interface{}, len(check.Settings))
+	for k, v := range check.Settings {
+		settings[k] = v
+	}
+	for _, k := range schedulerSettings {
+		delete(settings, k)
+	}
+	// maps are encoded with sorted keys, so equal settings give the same key.
+	body, err := json.Marshal(settings)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%d:%s", check.Type, t.Unix(), body), nil
+}
+
+// run returns the result of the execution of the check in tick t, calling fn
+// if no identical check has already been executed in that tick.
+func (ec *execCache) run(check *m.CheckWithSlug, t time.Time, fn func() (checks.CheckResult, int, error)) (checks.CheckResult, int, error) {
+	key, err := coalesceKey(check, t)
+	if err != nil {
+		return fn()
+	}
+	ec.Lock()
+	if entry, ok := ec.entries[key]; ok {
+		ec.Unlock()
+		<-entry.done
+		schedulerChecksCoalesced.Inc()
+		return entry.results, entry.attempts, entry.err
+	}
+	entry := &execEntry{done: make(chan struct{})}
+	ec.entries[key] = entry
+	ec.Unlock()
+
+	entry.results, entry.attempts, entry.err = fn()
+	close(entry.done)
+
+	// keep the result for checks that reach this tick late. The key contains
+	// the tick, so later ticks never match it.
+	time.AfterFunc(time.Duration(check.Frequency)*time.Second, func() {
+		ec.Lock()
+		delete(ec.entries, key)
+		ec.Unlock()
+	})
+	return entry.results, entry.attempts, entry.err
+}
@@ -0,0 +1,128 @@
+package scheduler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/grafana/metrictank/schema"
+	"github.com/raintank/raintank-probe/checks"
+	"github.com/raintank/raintank-probe/probe"
+	"github.com/raintank/raintank-probe/publisher"
+	m "github.com/raintank/worldping-api/pkg/models"
+)
+
+// Execute runs the check once, outside of any CheckInstance schedule, and
+// returns the result along with the metrics that a scheduled run would emit.
+// Nothing is published and no CheckInstance state is changed, so the check is
+// never flapping and has no overruns.
+func Execute(check *m.CheckWithSlug, t time.Time) (checks.CheckResult, []*schema.MetricData, error) {
+	if probe.Self == nil {
+		return nil, nil, fmt.Errorf("probe identity is not yet known")
+	}
+	exec, err := GetCheck(check.Type, check.Settings)
+	if err != nil {
+		return nil, nil, err
+	}
+	retry, err := getRetryPolicy(check.Settings)
+	if err != nil {
+		return nil, nil, err
+	}
+	result, attempts, err := retry.run(exec, check, t)
+	if err != nil {
+		return nil, nil, err
+	}
+	state := m.EvalResultOK
+	warn, err := getWarnThresholds(check.Type, check.Settings)
+	if err != nil {
+		return nil, nil, err
+	}
+	if result.ErrorMsg() != "" {
+		state = m.EvalResultCrit
+	} else if warn.check(result) != "" {
+		state = m.EvalResultWarn
+	}
+	return result, runMetrics(check, t, result, state, false, attempts, 0), nil
+}
+
+// runMetrics returns the metrics published for a run of the check: the
+// metrics of the result, followed by the state, flapping, probe_paused,
+// attempts and overrun metrics.
+func runMetrics(check *m.CheckWithSlug, t time.Time, result checks.CheckResult, state m.CheckEvalResult, flapping bool, attempts, overruns int) []*schema.MetricData {
+	metrics := append(result.Metrics(t, check), stateMetrics(check, t, state)...)
+	metrics = append(metrics, flappingMetric(check, t, flapping))
+	metrics = append(metrics, pausedMetric(check, t, false))
+	metrics = append(metrics, gaugeMetric(check, t, "attempts", "count", float64(attempts)))
+	overrunMetric := gaugeMetric(check, t, "overrun", "count", float64(overruns))
+	overrunMetric.Mtype = "counter"
+	metrics = append(metrics, overrunMetric)
+	for _, md := range metrics {
+		md.SetId()
+	}
+	return metrics
+}
+
+// stateMetrics returns the ok_state, warn_state and error_state metrics for a
+// check. Exactly one of them is 1.
+func stateMetrics(check *m.CheckWithSlug, t time.Time, state m.CheckEvalResult) []*schema.MetricData {
+	okState := 0.0
+	warnState := 0.0
+	errState := 0.0
+	switch state {
+	case m.EvalResultCrit:
+		errState = 1
+	case m.EvalResultWarn:
+		warnState = 1
+	default:
+		okState = 1
+	}
+	return []*schema.MetricData{
+		gaugeMetric(check, t, "ok_state", "state", okState),
+		gaugeMetric(check, t, "warn_state", "state", warnState),
+		gaugeMetric(check, t, "error_state", "state", errState),
+	}
+}
+
+// flappingMetric returns the flapping metric for a check, 1 while the check is flapping.
+func flappingMetric(check *m.CheckWithSlug, t time.Time, flapping bool) *schema.MetricData {
+	value := 0.0
+	if flapping {
+		value = 1
+	}
+	return gaugeMetric(check, t, "flapping", "state", value)
+}
+
+// pausedMetric returns the probe_paused metric for a check, 1 while the check
+// is not executed because the probe is unhealthy.
+func pausedMetric(check *m.CheckWithSlug, t time.Time, paused bool) *schema.MetricData {
+	value := 0.0
+	if paused {
+		value = 1
+	}
+	return gaugeMetric(check, t, "probe_paused", "state", value)
+}
+
+// publishPaused publishes the metrics for a tick of a paused check. Only the
+// probe_paused metric is sent, so the state metrics are absent for the tick
+// rather than reporting the target as up or down.
+func publishPaused(check *m.CheckWithSlug, t time.Time) {
+	if probe.Self == nil {
+		return
+	}
+	md := pausedMetric(check, t, true)
+	md.SetId()
+	publisher.Publisher.Add([]*schema.MetricData{md})
+}
+
+// gaugeMetric returns a gauge for the check with the passed name suffix.
+func gaugeMetric(check *m.CheckWithSlug, t time.Time, name, unit string, value float64) *schema.MetricData {
+	return &schema.MetricData{
+		OrgId:    int(check.OrgId),
+		Name:     fmt.Sprintf("worldping.%s.%s.%s.%s", check.Slug, probe.Self.Slug, check.Type, name),
+		Interval: int(check.Frequency),
+		Unit:     unit,
+		Mtype:    "gauge",
+		Time:     t.Unix(),
+		Tags:     nil,
+		Value:    value,
+	}
+}
@@ -0,0 +1,55 @@
+package scheduler
+
+import (
+	m "github.com/raintank/worldping-api/pkg/models"
+)
+
+// flapDetector tracks the state of the last runs of a check. A check is
+// flapping when the share of runs that changed state, over a window of
+// Config.FlapWindow runs, reaches Config.FlapHighThreshold. It stops flapping
+// once the share drops to Config.FlapLowThreshold.
+type flapDetector struct {
+	// states of the most recent runs, oldest first.
+	states   []m.CheckEvalResult
+	flapping bool
+}
+
+// record adds the state of a run and returns true if the check started or
+// stopped flapping.
+func (f *flapDetector) record(state m.CheckEvalResult, cfg *Config) bool {
+	if cfg == nil || cfg.FlapWindow < 2 {
+		return false
+	}
+	f.states = append(f.states, state)
+	if len(f.states) > cfg.FlapWindow {
+		f.states = f.states[len(f.states)-cfg.FlapWindow:]
+	}
+	if len(f.states) < cfg.FlapWindow {
+		// not enough history yet.
+		return false
+	}
+	ratio := f.ratio()
+	if !f.flapping && ratio >= cfg.FlapHighThreshold {
+		f.flapping = true
+		return true
+	}
+	if f.flapping && ratio <= cfg.FlapLowThreshold {
+		f.flapping = false
+		return true
+	}
+	return false
+}
+
+// ratio returns the share of runs in the window that changed state.
+func (f *flapDetector) ratio() float64 {
+	if len(f.states) < 2 {
+		return 0
+	}
+	changes := 0
+	for i := 1; i < len(f.states); i++ {
+		if f.states[i] != f.states[i-1] {
+			changes++
+		}
+	}
+	return float64(changes) / float64(len(f.states)-1)
+}
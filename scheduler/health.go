@@ -1,11 +1,23 @@
 package scheduler
 
 import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/grafana/metrictank/schema"
 	"github.com/grafana/metrictank/stats"
+	eventMsg "github.com/grafana/worldping-gw/msg"
 	"github.com/raintank/raintank-probe/checks"
+	"github.com/raintank/raintank-probe/probe"
+	"github.com/raintank/raintank-probe/publisher"
+	m "github.com/raintank/worldping-api/pkg/models"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -13,91 +25,524 @@ var (
 	schedulerHealth = stats.NewGauge32("scheduler.healthy")
 )
 
-// Ping scheduler.HealthHosts to determin if this probe is healthy and should
-// execute checks.  If all of the HealthHosts are experiencing issues, then
-// there is likely something wrong with this probe so it should stop executing
-// checks until things recover.
+// HealthConfig controls how the probe decides whether it is healthy enough to
+// execute checks.
+type HealthConfig struct {
+	// targets checked to determine the health of the probe. If empty, the
+	// scheduler's HealthHosts are pinged.
+	Targets []*HealthTarget
+	// how often the targets are checked, and the timeout for each check.
+	Interval time.Duration
+	Timeout  time.Duration
+	// share of the total weight of the targets that must fail for the probe
+	// to be unhealthy.
+	Threshold float64
+	// number of consecutive evaluations with a different result needed
+	// before the probe changes state. The first evaluation always applies.
+	Hysteresis int
+}
+
+// HealthTarget is a host checked to determine the health of the probe.
+type HealthTarget struct {
+	// the target as passed to ParseHealthTargets, without the weight.
+	Name   string
+	Type   string
+	Weight float64
+
+	host   string
+	port   int
+	path   string
+	record string
+	check  healthCheck
+
+	healthy *stats.Gauge32
+	latency *stats.Gauge32
+}
+
+// healthCheck is implemented by the checks in the checks package, and by
+// tcpHealthCheck.
+type healthCheck interface {
+	Run() (checks.CheckResult, error)
+}
+
+// HealthResult is the result of the last check of a HealthTarget.
+type HealthResult struct {
+	Name   string  `json:"name"`
+	Type   string  `json:"type"`
+	Weight float64 `json:"weight"`
+	// 0 is healthy, 1 is failing and 3 means the check could not be run.
+	Score   int     `json:"score"`
+	Error   string  `json:"error,omitempty"`
+	Latency float64 `json:"latency"`
+	// packet loss in percent, only set for ping targets.
+	Loss      *float64  `json:"loss,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// HealthStatus is the result of the last health evaluation of the probe.
+type HealthStatus struct {
+	Healthy bool `json:"healthy"`
+	// share of the total weight of the targets that failed.
+	Failed float64 `json:"failed"`
+	// number of consecutive evaluations that disagree with the current state.
+	Pending int            `json:"pending"`
+	Targets []HealthResult `json:"targets"`
+}
+
+var healthWeight = regexp.MustCompile(`=([0-9]*\.?[0-9]+)$`)
+
+// ParseHealthTargets parses a comma separated list of health targets. Each
+// target is one of
 //
-func (s *Scheduler) CheckHealth() {
-	chks := make([]*checks.RaintankProbePing, len(s.HealthHosts))
-	for i, host := range s.HealthHosts {
-		settings := make(map[string]interface{})
-		settings["timeout"] = 2.0
-		settings["hostname"] = host
-		chk, err := checks.NewRaintankPingProbe(settings)
+//	ping:<host>
+//	dns:<server>[/<name>]
+//	tcp:<host>:<port>
+//	http://<host>[:<port>][/<path>]
+//	https://<host>[:<port>][/<path>]
+//
+// optionally followed by =<weight>. The default weight is 1. As a = in a
+// query string is part of the url, http and https targets with a query string
+// can not set a weight.
+func ParseHealthTargets(list string) ([]*HealthTarget, error) {
+	targets := make([]*HealthTarget, 0)
+	for _, spec := range strings.Split(list, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		target, err := parseHealthTarget(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health target %q. %s", spec, err)
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+func parseHealthTarget(spec string) (*HealthTarget, error) {
+	t := &HealthTarget{Name: spec, Weight: 1}
+	// a = in the query string of a url is part of the url, not a weight.
+	if match := healthWeight.FindStringSubmatch(spec); match != nil && !inURLQuery(spec) {
+		weight, err := strconv.ParseFloat(match[1], 64)
+		if err != nil {
+			return nil, err
+		}
+		t.Weight = weight
+		t.Name = strings.TrimSuffix(spec, match[0])
+	}
+	if t.Weight <= 0 {
+		return nil, fmt.Errorf("weight must be greater then 0.")
+	}
+	parts := strings.SplitN(t.Name, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("must be type:target.")
+	}
+	t.Type = parts[0]
+	switch t.Type {
+	case string(m.PING_CHECK):
+		t.host = parts[1]
+	case string(m.DNS_CHECK):
+		t.host = parts[1]
+		t.record = "."
+		if i := strings.Index(parts[1], "/"); i >= 0 {
+			t.host = parts[1][:i]
+			if name := parts[1][i+1:]; name != "" {
+				t.record = name
+			}
+		}
+	case "tcp":
+		host, port, err := net.SplitHostPort(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		t.host = host
+		t.port, err = strconv.Atoi(port)
+		if err != nil || t.port < 1 || t.port > 65535 {
+			return nil, fmt.Errorf("invalid port number.")
+		}
+	case string(m.HTTP_CHECK), string(m.HTTPS_CHECK):
+		u, err := url.Parse(t.Name)
 		if err != nil {
+			return nil, err
+		}
+		t.host = u.Hostname()
+		t.path = u.RequestURI()
+		if u.Port() != "" {
+			t.port, err = strconv.Atoi(u.Port())
+			if err != nil {
+				return nil, fmt.Errorf("invalid port number.")
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown type %s. must be one of ping, dns, tcp, http or https.", t.Type)
+	}
+	if t.host == "" {
+		return nil, fmt.Errorf("no host passed.")
+	}
+	// validate the settings of the check.
+	if err := t.init(2 * time.Second); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// inURLQuery returns true if spec is a http or https target with a query
+// string.
+func inURLQuery(spec string) bool {
+	if !strings.HasPrefix(spec, string(m.HTTP_CHECK)+"://") && !strings.HasPrefix(spec, string(m.HTTPS_CHECK)+"://") {
+		return false
+	}
+	return strings.Contains(spec, "?")
+}
+
+// init creates the check run for the target.
+func (t *HealthTarget) init(timeout time.Duration) error {
+	settings := map[string]interface{}{
+		"timeout": timeout.Seconds(),
+	}
+	// health targets are configured by the operator of the probe, so the
+	// destination policy for checks does not apply to them.
+	switch t.Type {
+	case string(m.PING_CHECK):
+		settings["hostname"] = t.host
+		check, err := checks.NewRaintankPingProbe(settings)
+		if err != nil {
+			return err
+		}
+		check.Policy = checks.Unrestricted
+		t.check = check
+	case string(m.DNS_CHECK):
+		settings["server"] = t.host
+		settings["name"] = t.record
+		settings["type"] = "NS"
+		check, err := checks.NewRaintankDnsProbe(settings)
+		if err != nil {
+			return err
+		}
+		check.Policy = checks.Unrestricted
+		t.check = check
+	case "tcp":
+		t.check = &tcpHealthCheck{host: t.host, port: t.port, timeout: timeout}
+	case string(m.HTTP_CHECK):
+		t.httpSettings(settings)
+		check, err := checks.NewRaintankHTTPProbe(settings)
+		if err != nil {
+			return err
+		}
+		check.Policy = checks.Unrestricted
+		t.check = check
+	case string(m.HTTPS_CHECK):
+		t.httpSettings(settings)
+		settings["validateCert"] = true
+		check, err := checks.NewRaintankHTTPSProbe(settings)
+		if err != nil {
+			return err
+		}
+		check.Policy = checks.Unrestricted
+		t.check = check
+	}
+	return nil
+}
+
+func (t *HealthTarget) httpSettings(settings map[string]interface{}) {
+	settings["host"] = t.host
+	settings["path"] = t.path
+	if t.port != 0 {
+		settings["port"] = float64(t.port)
+	}
+}
+
+// run checks the target, returning its score.
+func (t *HealthTarget) run() HealthResult {
+	result := HealthResult{
+		Name:      t.Name,
+		Type:      t.Type,
+		Weight:    t.Weight,
+		Timestamp: time.Now(),
+	}
+	results, err := t.check.Run()
+	result.Latency = float64(time.Since(result.Timestamp).Nanoseconds()) / float64(time.Millisecond)
+	if ping, ok := results.(*checks.PingResult); ok && err == nil {
+		// the ping check sends several packets, so use the average round trip.
+		if ping.Avg != nil {
+			result.Latency = *ping.Avg
+		}
+		result.Loss = ping.Loss
+	}
+	if err != nil {
+		log.Warningf("Health check to %s failed. %s", t.Name, err)
+		result.Score = 3
+		result.Error = err.Error()
+	} else if msg := results.ErrorMsg(); msg != "" {
+		log.Warningf("Health check to %s failed. %s", t.Name, msg)
+		result.Score = 1
+		result.Error = msg
+	} else {
+		log.Debugf("Health check completed for %s", t.Name)
+	}
+	if result.Score == 0 {
+		t.healthy.Set(1)
+	} else {
+		t.healthy.Set(0)
+	}
+	t.latency.Set(int(result.Latency))
+	return result
+}
+
+var statName = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// CheckHealth checks the health targets to determine if this probe is
+// healthy and should execute checks. If most of the targets are experiencing
+// issues, then there is likely something wrong with this probe so it should
+// stop executing checks until things recover.
+func (s *Scheduler) CheckHealth() {
+	cfg := s.cfg.Health
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Second * 5
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Second * 2
+	}
+	if cfg.Threshold <= 0 {
+		cfg.Threshold = 0.5
+	}
+	if cfg.Hysteresis < 1 {
+		cfg.Hysteresis = 1
+	}
+	targets := cfg.Targets
+	if len(targets) == 0 {
+		for _, host := range s.HealthHosts {
+			targets = append(targets, &HealthTarget{Name: host, Type: string(m.PING_CHECK), Weight: 1, host: host})
+		}
+	}
+	totalWeight := 0.0
+	for _, t := range targets {
+		if err := t.init(cfg.Timeout); err != nil {
 			log.Fatalf("unable to create health check. %s", err)
 		}
-		chks[i] = chk
+		name := slugifyTarget(t.Name)
+		t.healthy = stats.NewGauge32(fmt.Sprintf("scheduler.health.%s.healthy", name))
+		t.latency = stats.NewGauge32(fmt.Sprintf("scheduler.health.%s.latency", name))
+		totalWeight += t.Weight
 	}
 	schedulerHealth.Set(0)
-	lastState := 1
+	evaluated := false
+	pending := 0
 
-	ticker := time.NewTicker(time.Second * 5)
+	ticker := time.NewTicker(cfg.Interval)
 	var wg sync.WaitGroup
 	for range ticker.C {
-		resultsCh := make(chan int, len(chks))
-		for i := range chks {
-			check := chks[i]
+		results := make([]HealthResult, len(targets))
+		for i := range targets {
 			wg.Add(1)
-			go func(ch chan int, chk *checks.RaintankProbePing) {
+			go func(t *HealthTarget, result *HealthResult) {
 				defer wg.Done()
-				results, err := chk.Run()
-				if err != nil {
-					log.Warningf("Health check to %s failed. %s", chk.Hostname, err)
-					ch <- 3
-					return
-				}
-				if results.ErrorMsg() != "" {
-					log.Warningf("Health check to %s failed. %s", chk.Hostname, results.ErrorMsg())
-					ch <- 1
-					return
-				}
-				log.Debugf("Health check completed for %s", chk.Hostname)
-				ch <- 0
-			}(resultsCh, check)
+				*result = t.run()
+			}(targets[i], &results[i])
 		}
 		wg.Wait()
-		close(resultsCh)
-		score := 0
-		for r := range resultsCh {
-			if r == 3 {
+
+		failed := 0.0
+		for _, r := range results {
+			if r.Score == 3 {
 				// fatal error, trying to run the check.
-				score = len(chks)
-			} else {
-				score += r
+				failed = totalWeight
+				break
 			}
-		}
-		newState := 0
-		// if more the 50% of healthHosts are down, then we consider ourselves down.
-		if float64(score) > float64(len(chks)/2.0) {
-			newState = 1
-		}
-
-		if newState != lastState {
-			if newState == 1 {
-				// we are now unhealthy.
-				schedulerHealth.Set(0)
-				s.Lock()
-				log.Warning("This probe is in an unhealthy state. Stopping execution of checks.")
-				s.Healthy = false
-				for _, instance := range s.Checks {
-					instance.Stop()
-				}
-				s.Unlock()
-			} else {
-				//we are now healthy.
-				schedulerHealth.Set(1)
-				s.Lock()
-				log.Warning("This probe is now healthy again. Resuming execution of checks.")
-				s.Healthy = true
-				for _, instance := range s.Checks {
-					log.Debugf("resuming %s check for %s", instance.Check.Type, instance.Check.Slug)
-					instance.Run()
-				}
-				s.Unlock()
+			if r.Score != 0 {
+				failed += r.Weight
 			}
-			lastState = newState
 		}
+		healthy := true
+		if totalWeight > 0 {
+			failed = failed / totalWeight
+			// if more than Threshold of the targets are down, then we consider ourselves down.
+			healthy = failed <= cfg.Threshold
+		}
+
+		s.Lock()
+		for _, r := range results {
+			s.healthScores[r.Name] = r.Score
+		}
+		if healthy == s.Healthy {
+			pending = 0
+		} else {
+			pending++
+		}
+		// the first evaluation applies immediately.
+		change := pending > 0 && (!evaluated || pending >= cfg.Hysteresis)
+		transition := change && evaluated
+		if change {
+			pending = 0
+		} else if pending > 0 {
+			log.Infof("health evaluation %d of %d before changing the health state of this probe.", pending, cfg.Hysteresis)
+		}
+		evaluated = true
+		sort.Slice(results, func(i, j int) bool {
+			return results[i].Name < results[j].Name
+		})
+		s.health = HealthStatus{
+			Healthy: s.Healthy,
+			Failed:  failed,
+			Pending: pending,
+			Targets: results,
+		}
+		s.Unlock()
+
+		publishHealthMetrics(results, cfg.Interval)
+		if change {
+			s.setHealthy(healthy)
+		}
+		// becoming healthy on startup is not a transition.
+		if transition {
+			publishHealthEvent(healthy, failed, results)
+		}
+	}
+}
+
+// publishHealthMetrics publishes the results of the health targets as metrics
+// of the probe, so problems with the probe can be correlated with gaps in the
+// metrics of its checks.
+func publishHealthMetrics(results []HealthResult, interval time.Duration) {
+	if probe.Self == nil {
+		return
+	}
+	seconds := int(interval.Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+	metrics := make([]*schema.MetricData, 0, len(results)*3)
+	for _, r := range results {
+		name := fmt.Sprintf("worldping.probe.%s.health.%s", probe.Self.Slug, slugifyTarget(r.Name))
+		if r.Score != 0 {
+			metrics = append(metrics, healthMetric(name+".healthy", "state", 0, r.Timestamp, seconds))
+		} else {
+			metrics = append(metrics,
+				healthMetric(name+".healthy", "state", 1, r.Timestamp, seconds),
+				healthMetric(name+".latency", "ms", r.Latency, r.Timestamp, seconds),
+			)
+		}
+		if r.Loss != nil {
+			metrics = append(metrics, healthMetric(name+".loss", "percent", *r.Loss, r.Timestamp, seconds))
+		}
+	}
+	publisher.Publisher.Add(metrics)
+}
+
+func healthMetric(name, unit string, value float64, t time.Time, interval int) *schema.MetricData {
+	md := &schema.MetricData{
+		OrgId:    int(probe.Self.OrgId),
+		Name:     name,
+		Interval: interval,
+		Unit:     unit,
+		Mtype:    "gauge",
+		Time:     t.Unix(),
+		Tags:     nil,
+		Value:    value,
+	}
+	md.SetId()
+	return md
+}
+
+// publishHealthEvent sends an event when checks are stopped or resumed
+// because of the health of the probe, with the result of each health target.
+func publishHealthEvent(healthy bool, failed float64, results []HealthResult) {
+	if probe.Self == nil {
+		return
+	}
+	targets := make([]string, len(results))
+	for i, r := range results {
+		if r.Score == 0 {
+			targets[i] = fmt.Sprintf("%s ok (%.1fms)", r.Name, r.Latency)
+		} else {
+			targets[i] = fmt.Sprintf("%s failed (%s)", r.Name, r.Error)
+		}
+	}
+	event := eventMsg.ProbeEvent{
+		EventType: "probe_health",
+		OrgId:     probe.Self.OrgId,
+		Severity:  "OK",
+		Source:    "probe_health",
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		Message:   fmt.Sprintf("Probe is healthy again, resuming checks. %s", strings.Join(targets, ", ")),
+		Tags: map[string]string{
+			"collector": probe.Self.Slug,
+			"healthy":   "true",
+			"failed":    strconv.FormatFloat(failed, 'f', 2, 64),
+		},
+	}
+	if !healthy {
+		event.Severity = "ERROR"
+		event.Message = fmt.Sprintf("Probe is unhealthy, pausing checks. %s", strings.Join(targets, ", "))
+		event.Tags["healthy"] = "false"
+	}
+	publisher.Publisher.AddEvent(nil, &event)
+}
+
+func slugifyTarget(name string) string {
+	return strings.Trim(statName.ReplaceAllString(name, "_"), "_")
+}
+
+// setHealthy stops or resumes the execution of checks.
+func (s *Scheduler) setHealthy(healthy bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.Healthy = healthy
+	s.health.Healthy = healthy
+	if !healthy {
+		// we are now unhealthy.
+		schedulerHealth.Set(0)
+		log.Warning("This probe is in an unhealthy state. Pausing execution of checks.")
+		for _, instance := range s.Checks {
+			instance.Pause()
+		}
+		return
+	}
+	//we are now healthy.
+	schedulerHealth.Set(1)
+	log.Warning("This probe is now healthy again. Resuming execution of checks.")
+	for _, instance := range s.Checks {
+		instance.Resume()
+	}
+}
+
+// Health returns the result of the last health evaluation.
+func (s *Scheduler) Health() HealthStatus {
+	s.RLock()
+	defer s.RUnlock()
+	status := s.health
+	status.Targets = append(make([]HealthResult, 0, len(s.health.Targets)), s.health.Targets...)
+	return status
+}
+
+// tcpHealthCheck succeeds if a TCP connection can be made to host:port.
+type tcpHealthCheck struct {
+	host    string
+	port    int
+	timeout time.Duration
+}
+
+type tcpHealthResult struct {
+	err string
+}
+
+func (r *tcpHealthResult) ErrorMsg() string {
+	return r.err
+}
+
+func (r *tcpHealthResult) Metrics(t time.Time, check *m.CheckWithSlug) []*schema.MetricData {
+	return nil
+}
+
+func (c *tcpHealthCheck) Run() (checks.CheckResult, error) {
+	addr, err := checks.ResolveHost(c.host, "any", checks.Unrestricted)
+	if err != nil {
+		return &tcpHealthResult{err: err.Error()}, nil
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(addr, strconv.Itoa(c.port)), c.timeout)
+	if err != nil {
+		return &tcpHealthResult{err: err.Error()}, nil
 	}
+	conn.Close()
+	return &tcpHealthResult{}, nil
 }
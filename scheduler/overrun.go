@@ -0,0 +1,128 @@
+package scheduler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+	eventMsg "github.com/grafana/worldping-gw/msg"
+	"github.com/raintank/raintank-probe/probe"
+	"github.com/raintank/raintank-probe/publisher"
+	log "github.com/sirupsen/logrus"
+)
+
+var schedulerChecksOverrun = stats.NewCounterRate32("scheduler.checks.overrun")
+
+// overrunPolicy controls what happens when a check is due while its previous
+// run is still in progress. It is read from the optional "overrun" check setting.
+type overrunPolicy string
+
+const (
+	// skip the new run.
+	overrunSkip overrunPolicy = "skip"
+	// run once the previous run completes. At most one run is queued. This is
+	// the default, as ticks were always buffered this way.
+	overrunQueue overrunPolicy = "queue"
+	// start the new run alongside the previous one.
+	overrunConcurrent overrunPolicy = "concurrent"
+)
+
+func getOverrunPolicy(settings map[string]interface{}) (overrunPolicy, error) {
+	raw, ok := settings["overrun"]
+	if !ok {
+		return overrunQueue, nil
+	}
+	value, ok := raw.(string)
+	if !ok {
+		return "", fmt.Errorf("invalid value for overrun, must be string.")
+	}
+	switch p := overrunPolicy(value); p {
+	case overrunSkip, overrunQueue, overrunConcurrent:
+		return p, nil
+	case "":
+		return overrunQueue, nil
+	default:
+		return "", fmt.Errorf("invalid value for overrun, must be one of skip, queue or concurrent.")
+	}
+}
+
+// dispatch starts a run of the check for the tick t, applying the overrun
+// policy if the previous run has not yet completed.
+func (c *CheckInstance) dispatch(t time.Time) {
+	c.Lock()
+	if c.running == 0 {
+		c.running++
+		c.Unlock()
+		go c.execute(t)
+		return
+	}
+
+	c.overruns++
+	c.consecutiveOverruns++
+	schedulerChecksOverrun.Inc()
+	desc := fmt.Sprintf("%s check for %s", c.Check.Type, c.Check.Slug)
+	policy := c.overrun
+	check := c.Check
+	notify := false
+	threshold := 0
+	if c.cfg != nil {
+		threshold = c.cfg.OverrunEventThreshold
+	}
+	if threshold > 0 && c.consecutiveOverruns >= threshold && !c.overrunNotified {
+		c.overrunNotified = true
+		notify = true
+	}
+	switch policy {
+	case overrunSkip:
+		log.Warningf("previous run of %s has not completed, skipping run.", desc)
+	case overrunConcurrent:
+		log.Warningf("previous run of %s has not completed, running concurrently.", desc)
+		c.running++
+	default:
+		log.Warningf("previous run of %s has not completed, queueing run.", desc)
+		c.queued = &t
+	}
+	c.Unlock()
+	if policy == overrunConcurrent {
+		go c.execute(t)
+	}
+
+	if notify {
+		log.Warningf("%s has overrun its frequency %d times without completing in time.", desc, threshold)
+		event := eventMsg.ProbeEvent{
+			EventType: "monitor_state",
+			OrgId:     check.OrgId,
+			Severity:  "WARN",
+			Source:    "monitor_collector",
+			Timestamp: t.UnixNano() / int64(time.Millisecond),
+			Message:   fmt.Sprintf("Monitor is unable to complete within its frequency of %ds.", check.Frequency),
+			Tags: map[string]string{
+				"endpoint":     check.Slug,
+				"collector":    probe.Self.Slug,
+				"monitor_type": string(check.Type),
+			},
+		}
+		publisher.Publisher.AddEvent(check, &event)
+	}
+}
+
+// execute runs the check for the tick t, followed by any run queued while it
+// was executing.
+func (c *CheckInstance) execute(t time.Time) {
+	for {
+		c.run(t)
+		c.Lock()
+		if time.Since(t) <= time.Duration(c.Check.Frequency)*time.Second {
+			c.consecutiveOverruns = 0
+			c.overrunNotified = false
+		}
+		if c.queued == nil {
+			c.running--
+			c.Unlock()
+			return
+		}
+		t = *c.queued
+		c.queued = nil
+		c.Unlock()
+	}
+}
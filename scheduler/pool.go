@@ -0,0 +1,66 @@
+package scheduler
+
+import (
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+	m "github.com/raintank/worldping-api/pkg/models"
+)
+
+var (
+	schedulerQueueWait    = stats.NewMeter32("scheduler.queue.wait", true)
+	schedulerQueueWaiting = stats.NewGauge32("scheduler.queue.waiting")
+	schedulerExecutions   = stats.NewGauge32("scheduler.executions.running")
+)
+
+// workerPool limits the number of checks executing at the same time, both in
+// total and for each check type. A limit of 0 means unlimited.
+type workerPool struct {
+	all    chan struct{}
+	byType map[m.CheckType]chan struct{}
+}
+
+func newWorkerPool(max int, perType map[m.CheckType]int) *workerPool {
+	p := &workerPool{
+		byType: make(map[m.CheckType]chan struct{}),
+	}
+	if max > 0 {
+		p.all = make(chan struct{}, max)
+	}
+	for checkType, limit := range perType {
+		if limit > 0 {
+			p.byType[checkType] = make(chan struct{}, limit)
+		}
+	}
+	return p
+}
+
+// acquire blocks until a check of the passed type can be executed and
+// returns how long it waited. release must be called once the check is done.
+func (p *workerPool) acquire(checkType m.CheckType) time.Duration {
+	start := time.Now()
+	schedulerQueueWaiting.Inc()
+	// take the per-type slot first, so checks waiting on their type's limit do
+	// not hold a slot that other types could use.
+	if q, ok := p.byType[checkType]; ok {
+		q <- struct{}{}
+	}
+	if p.all != nil {
+		p.all <- struct{}{}
+	}
+	schedulerQueueWaiting.Dec()
+	schedulerExecutions.Inc()
+	wait := time.Since(start)
+	schedulerQueueWait.Value(int(wait.Nanoseconds() / int64(time.Millisecond)))
+	return wait
+}
+
+func (p *workerPool) release(checkType m.CheckType) {
+	schedulerExecutions.Dec()
+	if p.all != nil {
+		<-p.all
+	}
+	if q, ok := p.byType[checkType]; ok {
+		<-q
+	}
+}
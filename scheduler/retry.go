@@ -0,0 +1,76 @@
+package scheduler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/raintank/raintank-probe/checks"
+	m "github.com/raintank/worldping-api/pkg/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// maximum number of retries a check can be configured with.
+const maxRetries = 5
+
+// retryPolicy controls how many times a failed check is re-run before the
+// failure is recorded. It is read from the optional "retries" and
+// "retryDelay" (in seconds) check settings.
+type retryPolicy struct {
+	retries int
+	delay   time.Duration
+}
+
+func getRetryPolicy(settings map[string]interface{}) (retryPolicy, error) {
+	p := retryPolicy{delay: time.Second}
+	if retries, ok := settings["retries"]; ok {
+		r, ok := retries.(float64)
+		if !ok {
+			return p, fmt.Errorf("invalid value for retries, must be number.")
+		}
+		if r < 0 || r > maxRetries {
+			return p, fmt.Errorf("invalid value for retries, must be between 0 and %d.", maxRetries)
+		}
+		if r != float64(int(r)) {
+			return p, fmt.Errorf("invalid value for retries, must be a whole number.")
+		}
+		p.retries = int(r)
+	}
+	if delay, ok := settings["retryDelay"]; ok {
+		d, ok := delay.(float64)
+		if !ok {
+			return p, fmt.Errorf("invalid value for retryDelay, must be number.")
+		}
+		if d < 0 {
+			return p, fmt.Errorf("invalid value for retryDelay, must not be negative.")
+		}
+		p.delay = time.Duration(time.Millisecond * time.Duration(int(1000.0*d)))
+	}
+	return p, nil
+}
+
+// run executes the check, re-running it after a failure until it succeeds or
+// the retries are used up. Retries are only made while there is time for them
+// to complete before the next scheduled run at t + frequency. The result of the
+// last attempt is returned, along with the number of attempts made.
+func (p retryPolicy) run(exec RaintankProbeCheck, check *m.CheckWithSlug, t time.Time) (checks.CheckResult, int, error) {
+	deadline := t.Add(time.Duration(check.Frequency) * time.Second)
+	attempts := 0
+	for {
+		attempts++
+		start := time.Now()
+		results, err := exec.Run()
+		if err == nil && results.ErrorMsg() == "" {
+			return results, attempts, nil
+		}
+		// assume the next attempt takes as long as this one.
+		if attempts > p.retries || time.Now().Add(p.delay+time.Since(start)).After(deadline) {
+			return results, attempts, err
+		}
+		if err != nil {
+			log.Debugf("attempt %d of %s check for %s failed, retrying. %s", attempts, check.Type, check.Slug, err)
+		} else {
+			log.Debugf("attempt %d of %s check for %s failed, retrying. %s", attempts, check.Type, check.Slug, results.ErrorMsg())
+		}
+		time.Sleep(p.delay)
+	}
+}
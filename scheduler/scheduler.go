@@ -1,12 +1,13 @@
 package scheduler
 
 import (
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/grafana/metrictank/schema"
 	"github.com/grafana/metrictank/stats"
 	eventMsg "github.com/grafana/worldping-gw/msg"
 	"github.com/raintank/raintank-probe/checks"
@@ -20,10 +21,17 @@ var (
 	schedulerCheckDelay    = stats.NewMeter32("scheduler.checks.delay", true)
 	schedulerChecksOK      = stats.NewCounterRate32("scheduler.checks.result.ok")
 	schedulerChecksError   = stats.NewCounterRate32("scheduler.checks.result.error")
+	schedulerChecksWarn    = stats.NewCounterRate32("scheduler.checks.result.warn")
 	schedulerChecksSkipped = stats.NewCounterRate32("scheduler.checks.skipped")
 	schedulerChecksRunning = stats.NewGauge32("scheduler.checks.running")
 )
 
+var ErrCheckNotFound = errors.New("check not found")
+
+// errWorkerWait is returned by a run that waited so long for a free worker
+// that it is too old to execute.
+var errWorkerWait = errors.New("waited too long for a free worker")
+
 type RaintankProbeCheck interface {
 	Run() (checks.CheckResult, error)
 }
@@ -36,25 +44,65 @@ type CheckInstance struct {
 	StateChange time.Time
 	LastError   string
 	stopped     bool
+	cfg         *Config
+	flap        flapDetector
+	retry       retryPolicy
+	warn        warnThresholds
+	overrun     overrunPolicy
+	// number of runs in progress, and the tick of a run waiting for them to
+	// complete when using the queue overrun policy.
+	running int
+	queued  *time.Time
+	// total number of overruns, the number since the last run that completed
+	// within the check frequency, and whether an event has been sent for them.
+	overruns            int
+	consecutiveOverruns int
+	overrunNotified     bool
+	// while the probe is unhealthy the check is not executed, and only a
+	// probe_paused metric is published for each tick.
+	paused bool
 	sync.RWMutex
 }
 
-func NewCheckInstance(c *m.CheckWithSlug, probeHealthy bool) (*CheckInstance, error) {
+func NewCheckInstance(c *m.CheckWithSlug, probeHealthy bool, cfg *Config) (*CheckInstance, error) {
 	log.Infof("Creating new CheckInstance for %s check for %s", c.Type, c.Slug)
 	executor, err := GetCheck(c.Type, c.Settings)
 	if err != nil {
 		return nil, err
 	}
+	retry, err := getRetryPolicy(c.Settings)
+	if err != nil {
+		return nil, err
+	}
+	warn, err := getWarnThresholds(c.Type, c.Settings)
+	if err != nil {
+		return nil, err
+	}
+	overrun, err := getOverrunPolicy(c.Settings)
+	if err != nil {
+		return nil, err
+	}
 	instance := &CheckInstance{
-		Check:  c,
-		Exec:   executor,
-		State:  m.EvalResultUnknown,
-		Ticker: NewTicker(c.Frequency, c.Offset),
+		Check:   c,
+		Exec:    executor,
+		retry:   retry,
+		warn:    warn,
+		overrun: overrun,
+		State:   m.EvalResultUnknown,
+		Ticker:  NewTicker(c.Frequency, checkOffset(c, cfg)),
+		cfg:     cfg,
+		paused:  !probeHealthy,
 	}
-	go instance.loop()
-	if probeHealthy {
-		instance.Run()
+	if cfg != nil && cfg.store != nil {
+		if saved, ok := cfg.store.get(c); ok {
+			log.Debugf("restoring %s state of %s check for %s", saved.State, c.Type, c.Slug)
+			instance.State = saved.State
+			instance.StateChange = saved.StateChange
+			instance.LastError = saved.LastError
+		}
 	}
+	go instance.loop()
+	instance.Run()
 	return instance, nil
 }
 
@@ -64,11 +112,28 @@ func (i *CheckInstance) Update(c *m.CheckWithSlug, probeHealthy bool) error {
 	if err != nil {
 		return err
 	}
+	retry, err := getRetryPolicy(c.Settings)
+	if err != nil {
+		return err
+	}
+	warn, err := getWarnThresholds(c.Type, c.Settings)
+	if err != nil {
+		return err
+	}
+	overrun, err := getOverrunPolicy(c.Settings)
+	if err != nil {
+		return err
+	}
 	i.Lock()
 	i.Check = c
 	i.Exec = executor
-	i.Ticker.Update(c.Frequency, c.Offset)
+	i.retry = retry
+	i.warn = warn
+	i.overrun = overrun
+	i.Ticker.Update(c.Frequency, checkOffset(c, i.cfg))
 	i.Unlock()
+	// the state now belongs to the new version of the check.
+	i.saveState()
 	return nil
 }
 
@@ -79,11 +144,32 @@ func (i *CheckInstance) Stop() {
 	i.Ticker.Stop()
 }
 
+// Pause stops executing the check, while continuing to publish a
+// probe_paused metric for each tick.
+func (i *CheckInstance) Pause() {
+	i.Lock()
+	log.Infof("pausing execution of %s check for %s", i.Check.Type, i.Check.Slug)
+	i.paused = true
+	i.Unlock()
+}
+
+// Resume starts executing the check again after Pause.
+func (i *CheckInstance) Resume() {
+	i.Lock()
+	log.Infof("resuming execution of %s check for %s", i.Check.Type, i.Check.Slug)
+	i.paused = false
+	i.Unlock()
+}
+
 func (i *CheckInstance) Delete() {
 	i.RLock()
 	log.Infof("stopping execution thread of %s check for %s", i.Check.Type, i.Check.Slug)
+	id := i.Check.Id
 	i.RUnlock()
 	i.Ticker.Delete()
+	if i.cfg != nil && i.cfg.store != nil {
+		i.cfg.store.remove(id)
+	}
 }
 
 func (i *CheckInstance) Run() {
@@ -93,12 +179,43 @@ func (i *CheckInstance) Run() {
 	i.Ticker.Start()
 }
 
+// CheckStatus is a snapshot of the state of a CheckInstance.
+type CheckStatus struct {
+	Check       *m.CheckWithSlug  `json:"check"`
+	State       m.CheckEvalResult `json:"state"`
+	StateName   string            `json:"stateName"`
+	StateChange time.Time         `json:"stateChange"`
+	LastError   string            `json:"lastError"`
+	Paused      bool              `json:"paused"`
+}
+
+func (i *CheckInstance) Status() CheckStatus {
+	i.RLock()
+	defer i.RUnlock()
+	return CheckStatus{
+		Check:       i.Check,
+		State:       i.State,
+		StateName:   i.State.String(),
+		StateChange: i.StateChange,
+		LastError:   i.LastError,
+		Paused:      i.paused,
+	}
+}
+
 func (c *CheckInstance) loop() {
 	c.RLock()
 	log.Infof("Starting execution loop for %s check for %s, Frequency: %d, Offset: %d", c.Check.Type, c.Check.Slug, c.Check.Frequency, c.Check.Offset)
 	c.RUnlock()
 	for t := range c.Ticker.C {
-		c.run(t)
+		c.RLock()
+		paused := c.paused
+		check := c.Check
+		c.RUnlock()
+		if paused {
+			publishPaused(check, t)
+			continue
+		}
+		c.dispatch(t)
 	}
 	c.RLock()
 	log.Infof("execution loop for %s check for %s has ended.", c.Check.Type, c.Check.Slug)
@@ -121,119 +238,271 @@ func (c *CheckInstance) run(t time.Time) {
 	}
 
 	exec := c.Exec
+	retry := c.retry
+	warn := c.warn
 	check := c.Check
 	state := c.State
 	stateChange := c.StateChange
 	lastError := c.LastError
+	overruns := c.overruns
 	c.Unlock()
 
-	log.Debugf("executing %s", desc)
-	results, err := exec.Run()
-	var metrics []*schema.MetricData
+	// failures are retried, so only a confirmed failure changes the state.
+	// When executions are coalesced only the check that executes takes a
+	// worker, the others wait for its result without holding one.
+	execute := func() (checks.CheckResult, int, error) {
+		// wait for a free worker. The time spent waiting is tracked separately
+		// and does not count towards the check's own timings.
+		if c.cfg != nil && c.cfg.pool != nil {
+			wait := c.cfg.pool.acquire(check.Type)
+			if wait > 100*time.Millisecond {
+				log.Debugf("%s waited %s for a free worker", desc, wait)
+			}
+			defer c.cfg.pool.release(check.Type)
+			if (time.Since(t) / time.Second) > time.Duration(check.Frequency) {
+				return nil, 0, errWorkerWait
+			}
+		}
+		log.Debugf("executing %s", desc)
+		return retry.run(exec, check, t)
+	}
+	var results checks.CheckResult
+	var attempts int
+	var err error
+	if c.cfg != nil && c.cfg.cache != nil {
+		results, attempts, err = c.cfg.cache.run(check, t, execute)
+	} else {
+		results, attempts, err = execute()
+	}
+	if err == errWorkerWait {
+		schedulerChecksSkipped.Inc()
+		log.Errorf("execution run of %s skipped due to waiting too long for a free worker.", desc)
+		return
+	}
 	if err != nil {
 		log.Errorf("Failed to execute %s: %s", desc, err)
 		return
 	}
-	metrics = results.Metrics(t, check)
-	log.Debugf("got %d metrics for %s", len(metrics), desc)
+	publisher.Publisher.AddResult(check, t, results)
 	// check if we need to send any events.  Events are sent on state change, or if the error reason has changed
-	// or the check has been in an error state for 10minutes.
+	// or the check has been in an error or warning state for 10minutes. While the check is flapping, these
+	// events are suppressed and the current state is sent once it stabilises.
 	newState := m.EvalResultOK
-	if msg := results.ErrorMsg(); msg != "" {
-		log.Debugf("%s failed: %s", desc, msg)
+	msg := results.ErrorMsg()
+	warnMsg := ""
+	if msg != "" {
 		newState = m.EvalResultCrit
-		if (state != newState) || (msg != lastError) || (time.Since(stateChange) > time.Minute*10) {
+	} else if warnMsg = warn.check(results); warnMsg != "" {
+		newState = m.EvalResultWarn
+	}
+	c.Lock()
+	flapChanged := c.flap.record(newState, c.cfg)
+	flapping := c.flap.flapping
+	c.Unlock()
+	if flapChanged && flapping {
+		log.Infof("%s is flapping, suppressing state change events", desc)
+		event := eventMsg.ProbeEvent{
+			EventType: "monitor_state",
+			OrgId:     check.OrgId,
+			Severity:  "WARN",
+			Source:    "monitor_collector",
+			Timestamp: t.UnixNano() / int64(time.Millisecond),
+			Message:   "Monitor is flapping between states.",
+			Tags: map[string]string{
+				"endpoint":     check.Slug,
+				"collector":    probe.Self.Slug,
+				"monitor_type": string(check.Type),
+				"flapping":     "true",
+			},
+		}
+		publisher.Publisher.AddEvent(check, &event)
+	} else if flapChanged {
+		log.Infof("%s is no longer flapping", desc)
+	}
+
+	if msg != "" {
+		log.Debugf("%s failed: %s", desc, msg)
+		if (state != newState) || (msg != lastError) || (time.Since(stateChange) > time.Minute*10) || flapChanged {
 			c.Lock()
 			c.State = newState
 			c.LastError = msg
 			c.StateChange = time.Now()
 			c.Unlock()
-			//send Error event.
-			log.Debugf("%s is in error state", desc)
+			c.saveState()
+			if !flapping {
+				//send Error event.
+				log.Debugf("%s is in error state", desc)
+				event := eventMsg.ProbeEvent{
+					EventType: "monitor_state",
+					OrgId:     check.OrgId,
+					Severity:  "ERROR",
+					Source:    "monitor_collector",
+					Timestamp: t.UnixNano() / int64(time.Millisecond),
+					Message:   msg,
+					Tags: map[string]string{
+						"endpoint":     check.Slug,
+						"collector":    probe.Self.Slug,
+						"monitor_type": string(check.Type),
+					},
+				}
+				publisher.Publisher.AddEvent(check, &event)
+			}
+		}
+	} else if warnMsg != "" {
+		log.Debugf("%s warning: %s", desc, warnMsg)
+		if (state != newState) || (warnMsg != lastError) || (time.Since(stateChange) > time.Minute*10) || flapChanged {
+			c.Lock()
+			c.State = newState
+			c.LastError = warnMsg
+			c.StateChange = time.Now()
+			c.Unlock()
+			c.saveState()
+			if !flapping {
+				//send Warn event.
+				log.Debugf("%s is in warning state", desc)
+				event := eventMsg.ProbeEvent{
+					EventType: "monitor_state",
+					OrgId:     check.OrgId,
+					Severity:  "WARN",
+					Source:    "monitor_collector",
+					Timestamp: t.UnixNano() / int64(time.Millisecond),
+					Message:   warnMsg,
+					Tags: map[string]string{
+						"endpoint":     check.Slug,
+						"collector":    probe.Self.Slug,
+						"monitor_type": string(check.Type),
+					},
+				}
+				publisher.Publisher.AddEvent(check, &event)
+			}
+		}
+	} else if state != newState || flapChanged {
+		c.Lock()
+		c.State = newState
+		c.StateChange = time.Now()
+		c.Unlock()
+		c.saveState()
+		if !flapping {
+			//send OK event.
+			log.Debugf("%s is now in OK state", desc)
 			event := eventMsg.ProbeEvent{
 				EventType: "monitor_state",
 				OrgId:     check.OrgId,
-				Severity:  "ERROR",
+				Severity:  "OK",
 				Source:    "monitor_collector",
 				Timestamp: t.UnixNano() / int64(time.Millisecond),
-				Message:   msg,
+				Message:   "Monitor now Ok.",
 				Tags: map[string]string{
 					"endpoint":     check.Slug,
 					"collector":    probe.Self.Slug,
 					"monitor_type": string(check.Type),
 				},
 			}
-			publisher.Publisher.AddEvent(&event)
-		}
-	} else if state != newState {
-		c.Lock()
-		c.State = newState
-		c.StateChange = time.Now()
-		c.Unlock()
-		//send OK event.
-		log.Debugf("%s is now in OK state", desc)
-		event := eventMsg.ProbeEvent{
-			EventType: "monitor_state",
-			OrgId:     check.OrgId,
-			Severity:  "OK",
-			Source:    "monitor_collector",
-			Timestamp: t.UnixNano() / int64(time.Millisecond),
-			Message:   "Monitor now Ok.",
-			Tags: map[string]string{
-				"endpoint":     check.Slug,
-				"collector":    probe.Self.Slug,
-				"monitor_type": string(check.Type),
-			},
+			publisher.Publisher.AddEvent(check, &event)
 		}
-		publisher.Publisher.AddEvent(&event)
 	}
 
-	// set or ok_state, error_state metrics.
-	okState := 0.0
-	errState := 0.0
-	if c.State == m.EvalResultCrit {
+	// set or ok_state, warn_state, error_state metrics.
+	switch newState {
+	case m.EvalResultCrit:
 		schedulerChecksError.Inc()
-		errState = 1
-	} else {
+	case m.EvalResultWarn:
+		schedulerChecksWarn.Inc()
+	default:
 		schedulerChecksOK.Inc()
-		okState = 1
-	}
-	metrics = append(metrics, &schema.MetricData{
-		OrgId:    int(check.OrgId),
-		Name:     fmt.Sprintf("worldping.%s.%s.%s.ok_state", check.Slug, probe.Self.Slug, check.Type),
-		Interval: int(check.Frequency),
-		Unit:     "state",
-		Mtype:    "gauge",
-		Time:     t.Unix(),
-		Tags:     nil,
-		Value:    okState,
-	}, &schema.MetricData{
-		OrgId:    int(check.OrgId),
-		Name:     fmt.Sprintf("worldping.%s.%s.%s.error_state", check.Slug, probe.Self.Slug, check.Type),
-		Interval: int(check.Frequency),
-		Unit:     "state",
-		Mtype:    "gauge",
-		Time:     t.Unix(),
-		Tags:     nil,
-		Value:    errState,
-	})
-
-	for _, m := range metrics {
-		m.SetId()
 	}
+	metrics := runMetrics(check, t, results, newState, flapping, attempts, overruns)
+	log.Debugf("got %d metrics for %s", len(metrics), desc)
 
 	//publish metrics to TSDB
 	publisher.Publisher.Add(metrics)
 }
 
+// Config holds the settings shared by all CheckInstances.
+type Config struct {
+	// number of runs over which state changes are counted to detect
+	// flapping checks. Values less than 2 disable flap detection.
+	FlapWindow int
+	// share of runs in the window that must change state for a check to be
+	// considered flapping, and the share at which it is considered stable again.
+	FlapHighThreshold float64
+	FlapLowThreshold  float64
+
+	// maximum number of checks executing at the same time, in total and for
+	// each check type. 0 means unlimited.
+	MaxConcurrency  int
+	TypeConcurrency map[m.CheckType]int
+
+	// number of overruns of a check, without a run completing within the
+	// check frequency, after which a WARN event is sent. 0 disables the event.
+	OverrunEventThreshold int
+
+	// spread checks without an offset across their frequency, rather than
+	// running them all at the start of the interval.
+	SpreadOffsets bool
+
+	// share a single execution between identical checks that run in the same tick.
+	CoalesceChecks bool
+
+	// how the health of the probe is determined.
+	Health HealthConfig
+
+	// file to save the state of each check to, so it is kept across
+	// restarts. Disabled if empty.
+	StateFile string
+
+	// shared by all CheckInstances, set up by New.
+	pool  *workerPool
+	cache *execCache
+	store *stateStore
+}
+
 type Scheduler struct {
 	sync.RWMutex
 	Checks      map[int64]*CheckInstance
 	HealthHosts []string
 	Healthy     bool
+	cfg         *Config
+
+	// result of the last health check of each health target.
+	healthScores map[string]int
+	health       HealthStatus
+	// checks that could not be started, and why.
+	failed map[int64]FailedCheck
 }
 
-func New(healthHosts string) *Scheduler {
+// FailedCheck is a check that could not be started by the scheduler.
+type FailedCheck struct {
+	Id    int64       `json:"id"`
+	Slug  string      `json:"endpointSlug"`
+	Type  m.CheckType `json:"type"`
+	Error string      `json:"error"`
+}
+
+// Status is a summary of the state of the scheduler.
+type Status struct {
+	Healthy bool `json:"healthy"`
+	// score of each health target. 0 is healthy, 1 is failing and 3 means the
+	// health check could not be run.
+	HealthScores map[string]int `json:"healthScores"`
+	// number of running checks.
+	Checks int `json:"checks"`
+	// number of running checks in each state.
+	States map[string]int `json:"states"`
+	Failed []FailedCheck  `json:"failed"`
+}
+
+func New(healthHosts string, cfg *Config) *Scheduler {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	cfg.pool = newWorkerPool(cfg.MaxConcurrency, cfg.TypeConcurrency)
+	if cfg.CoalesceChecks {
+		cfg.cache = newExecCache()
+	}
+	if cfg.StateFile != "" {
+		cfg.store = newStateStore(cfg.StateFile)
+	}
 	hosts := make([]string, 0)
 	for _, h := range strings.Split(healthHosts, ",") {
 		host := strings.TrimSpace(h)
@@ -242,8 +511,53 @@ func New(healthHosts string) *Scheduler {
 		}
 	}
 	return &Scheduler{
-		Checks:      make(map[int64]*CheckInstance),
-		HealthHosts: hosts,
+		Checks:       make(map[int64]*CheckInstance),
+		HealthHosts:  hosts,
+		healthScores: make(map[string]int),
+		failed:       make(map[int64]FailedCheck),
+		cfg:          cfg,
+	}
+}
+
+// Status returns a summary of the health of the probe and its checks.
+func (s *Scheduler) Status() Status {
+	s.RLock()
+	status := Status{
+		Healthy:      s.Healthy,
+		HealthScores: make(map[string]int, len(s.healthScores)),
+		Checks:       len(s.Checks),
+		States:       make(map[string]int),
+		Failed:       make([]FailedCheck, 0, len(s.failed)),
+	}
+	for host, score := range s.healthScores {
+		status.HealthScores[host] = score
+	}
+	for _, f := range s.failed {
+		status.Failed = append(status.Failed, f)
+	}
+	instances := make([]*CheckInstance, 0, len(s.Checks))
+	for _, instance := range s.Checks {
+		instances = append(instances, instance)
+	}
+	s.RUnlock()
+	for _, instance := range instances {
+		instance.RLock()
+		status.States[instance.State.String()]++
+		instance.RUnlock()
+	}
+	sort.Slice(status.Failed, func(i, j int) bool {
+		return status.Failed[i].Id < status.Failed[j].Id
+	})
+	return status
+}
+
+// setFailed records that the check could not be started. The caller must hold the lock.
+func (s *Scheduler) setFailed(c *m.CheckWithSlug, err error) {
+	s.failed[c.Id] = FailedCheck{
+		Id:    c.Id,
+		Slug:  c.Slug,
+		Type:  c.Type,
+		Error: err.Error(),
 	}
 }
 
@@ -261,6 +575,9 @@ func (s *Scheduler) Close() {
 		instance.Stop()
 	}
 	s.Checks = make(map[int64]*CheckInstance)
+	if s.cfg.store != nil {
+		s.cfg.store.close()
+	}
 	log.Info("scheduler Shutdown complete.")
 	return
 }
@@ -284,19 +601,30 @@ func (s *Scheduler) Refresh(checks []*m.CheckWithSlug) {
 					existing.Delete()
 					delete(s.Checks, c.Id)
 					schedulerChecksRunning.Dec()
+					s.setFailed(c, err)
 				}
 			}
 		} else {
 			log.Debugf("new check definition found for checkId=%d.", c.Id)
-			instance, err := NewCheckInstance(c, s.Healthy)
+			instance, err := NewCheckInstance(c, s.Healthy, s.cfg)
 			if err != nil {
 				log.Errorf("Unabled to create new check instance for checkId=%d. %s", c.Id, err)
+				s.setFailed(c, err)
 			} else {
 				s.Checks[c.Id] = instance
 				schedulerChecksRunning.Inc()
+				delete(s.failed, c.Id)
 			}
 		}
 	}
+	for id := range s.failed {
+		if _, ok := seenChecks[id]; !ok {
+			delete(s.failed, id)
+		}
+	}
+	if s.cfg.store != nil {
+		s.cfg.store.retain(seenChecks)
+	}
 	for id, instance := range s.Checks {
 		if _, ok := seenChecks[id]; !ok {
 			log.Infof("checkId=%d no longer scheduled to this probe, removing it.", id)
@@ -310,39 +638,42 @@ func (s *Scheduler) Refresh(checks []*m.CheckWithSlug) {
 	return
 }
 
-func (s *Scheduler) Create(check *m.CheckWithSlug) {
+func (s *Scheduler) Create(check *m.CheckWithSlug) error {
 	log.Infof("creating %s check for %s", check.Type, check.Slug)
 	s.Lock()
+	defer s.Unlock()
 	if existing, ok := s.Checks[check.Id]; ok {
 		log.Warningf("received create event for check that is already running. checkId=%d", check.Id)
 		existing.Delete()
 		delete(s.Checks, check.Id)
 		schedulerChecksRunning.Dec()
 	}
-	instance, err := NewCheckInstance(check, s.Healthy)
+	instance, err := NewCheckInstance(check, s.Healthy, s.cfg)
 	if err != nil {
 		log.Errorf("Unabled to create new check instance for checkId=%d. %s", check.Id, err)
-	} else {
-		s.Checks[check.Id] = instance
-		schedulerChecksRunning.Inc()
+		s.setFailed(check, err)
+		return err
 	}
-	s.Unlock()
-	return
+	s.Checks[check.Id] = instance
+	schedulerChecksRunning.Inc()
+	delete(s.failed, check.Id)
+	return nil
 }
 
-func (s *Scheduler) Update(check *m.CheckWithSlug) {
+func (s *Scheduler) Update(check *m.CheckWithSlug) error {
 	log.Infof("updating %s check for %s", check.Type, check.Slug)
 	s.Lock()
+	defer s.Unlock()
 	if existing, ok := s.Checks[check.Id]; !ok {
 		log.Warningf("received update event for check that is not currently running. checkId=%d", check.Id)
-		instance, err := NewCheckInstance(check, s.Healthy)
+		instance, err := NewCheckInstance(check, s.Healthy, s.cfg)
 		if err != nil {
 			log.Errorf("Unabled to create new check instance for checkId=%d. %s", check.Id, err)
-		} else {
-			s.Checks[check.Id] = instance
-			schedulerChecksRunning.Inc()
+			s.setFailed(check, err)
+			return err
 		}
-
+		s.Checks[check.Id] = instance
+		schedulerChecksRunning.Inc()
 	} else {
 		err := existing.Update(check, s.Healthy)
 		if err != nil {
@@ -350,27 +681,65 @@ func (s *Scheduler) Update(check *m.CheckWithSlug) {
 			existing.Delete()
 			delete(s.Checks, check.Id)
 			schedulerChecksRunning.Dec()
+			s.setFailed(check, err)
+			return err
 		}
 	}
-	s.Unlock()
-	return
+	delete(s.failed, check.Id)
+	return nil
 }
 
-func (s *Scheduler) Remove(check *m.CheckWithSlug) {
+func (s *Scheduler) Remove(check *m.CheckWithSlug) error {
 	log.Infof("removing %s check for %s", check.Type, check.Slug)
 	s.Lock()
-	if existing, ok := s.Checks[check.Id]; !ok {
+	defer s.Unlock()
+	delete(s.failed, check.Id)
+	existing, ok := s.Checks[check.Id]
+	if !ok {
 		log.Warningf("recieved remove event for check that is not currently running. checkId=%d", check.Id)
-	} else {
-		existing.Delete()
-		delete(s.Checks, check.Id)
-		schedulerChecksRunning.Dec()
+		return ErrCheckNotFound
 	}
-	s.Unlock()
-	return
+	existing.Delete()
+	delete(s.Checks, check.Id)
+	schedulerChecksRunning.Dec()
+	return nil
+}
+
+// Get returns the status of the check with the passed id.
+func (s *Scheduler) Get(id int64) (CheckStatus, bool) {
+	s.RLock()
+	instance, ok := s.Checks[id]
+	s.RUnlock()
+	if !ok {
+		return CheckStatus{}, false
+	}
+	return instance.Status(), true
+}
+
+// List returns the status of all running checks, ordered by check id.
+func (s *Scheduler) List() []CheckStatus {
+	s.RLock()
+	list := make([]CheckStatus, 0, len(s.Checks))
+	for _, instance := range s.Checks {
+		list = append(list, instance.Status())
+	}
+	s.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Check.Id < list[j].Check.Id
+	})
+	return list
 }
 
 func GetCheck(checkType m.CheckType, settings map[string]interface{}) (RaintankProbeCheck, error) {
+	if _, err := getRetryPolicy(settings); err != nil {
+		return nil, err
+	}
+	if _, err := getWarnThresholds(checkType, settings); err != nil {
+		return nil, err
+	}
+	if _, err := getOverrunPolicy(settings); err != nil {
+		return nil, err
+	}
 	switch checkType {
 	case m.PING_CHECK:
 		return checks.NewRaintankPingProbe(settings)
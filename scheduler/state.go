@@ -0,0 +1,225 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	m "github.com/raintank/worldping-api/pkg/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// stateWriteDelay is how long changes are collected before the state file is
+// written, so a burst of state changes results in a single write.
+var stateWriteDelay = time.Second
+
+// savedState is the state of a check saved to the state store.
+type savedState struct {
+	// the Updated time of the check definition the state belongs to.
+	Updated     time.Time         `json:"updated"`
+	State       m.CheckEvalResult `json:"state"`
+	StateChange time.Time         `json:"stateChange"`
+	LastError   string            `json:"lastError"`
+}
+
+// stateStore keeps the state of each check in a local file, so that checks
+// continue from their previous state after a restart instead of sending
+// events for state changes that did not happen. The file is written in the
+// background, so saving the state never blocks the checks.
+type stateStore struct {
+	sync.Mutex
+	path   string
+	states map[int64]savedState
+	// states has changes that are not yet written.
+	dirty bool
+
+	changed chan struct{}
+	done    chan struct{}
+	closed  chan struct{}
+}
+
+// newStateStore loads the state store at path. A missing or unreadable file
+// results in an empty store.
+func newStateStore(path string) *stateStore {
+	s := &stateStore{
+		path:    path,
+		states:  make(map[int64]savedState),
+		changed: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	go s.writer()
+	s.Lock()
+	defer s.Unlock()
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("unable to read check state file. %s", err)
+		}
+		return s
+	}
+	if err := json.Unmarshal(body, &s.states); err != nil {
+		log.Warnf("unable to parse check state file %s. %s", path, err)
+		s.states = make(map[int64]savedState)
+		return s
+	}
+	log.Infof("loaded the state of %d checks from %s", len(s.states), path)
+	return s
+}
+
+// get returns the saved state of the check, if it was saved for the same
+// version of the check definition.
+func (s *stateStore) get(c *m.CheckWithSlug) (savedState, bool) {
+	s.Lock()
+	defer s.Unlock()
+	state, ok := s.states[c.Id]
+	if !ok || !state.Updated.Equal(c.Updated) {
+		return savedState{}, false
+	}
+	return state, true
+}
+
+// set saves the state of the check.
+func (s *stateStore) set(id int64, state savedState) {
+	s.Lock()
+	defer s.Unlock()
+	if existing, ok := s.states[id]; ok && existing == state {
+		return
+	}
+	s.states[id] = state
+	s.save()
+}
+
+// retain removes the state of all checks not in ids.
+func (s *stateStore) retain(ids map[int64]struct{}) {
+	s.Lock()
+	defer s.Unlock()
+	changed := false
+	for id := range s.states {
+		if _, ok := ids[id]; !ok {
+			delete(s.states, id)
+			changed = true
+		}
+	}
+	if changed {
+		s.save()
+	}
+}
+
+// remove deletes the state of the check.
+func (s *stateStore) remove(id int64) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.states[id]; !ok {
+		return
+	}
+	delete(s.states, id)
+	s.save()
+}
+
+// save schedules a write of the store. The caller must hold the lock.
+func (s *stateStore) save() {
+	s.dirty = true
+	select {
+	case s.changed <- struct{}{}:
+	default:
+		// a write is already pending.
+	}
+}
+
+// close writes any pending changes and stops the writer.
+func (s *stateStore) close() {
+	close(s.done)
+	<-s.closed
+}
+
+// writer writes the store to disk after each change, waiting stateWriteDelay
+// to collect further changes.
+func (s *stateStore) writer() {
+	defer close(s.closed)
+	for {
+		select {
+		case <-s.changed:
+		case <-s.done:
+			s.flush()
+			return
+		}
+		select {
+		case <-time.After(stateWriteDelay):
+		case <-s.done:
+		}
+		s.flush()
+	}
+}
+
+// flush writes the store to disk if it changed since the last write.
+func (s *stateStore) flush() {
+	s.Lock()
+	if !s.dirty {
+		s.Unlock()
+		return
+	}
+	body, err := json.Marshal(s.states)
+	s.dirty = false
+	s.Unlock()
+	if err == nil {
+		err = WriteFileAtomic(s.path, body)
+	}
+	if err != nil {
+		log.Errorf("unable to save check state to %s. %s", s.path, err)
+		// try again with the next change.
+		s.Lock()
+		s.dirty = true
+		s.Unlock()
+	}
+}
+
+// WriteFileAtomic replaces the file at path with body. The file is synced
+// and then renamed into place, so a crash never leaves a partial file behind.
+func WriteFileAtomic(path string, body []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("unable to replace %s. %s", path, err)
+	}
+	return nil
+}
+
+// saveState saves the current state of the check to the state store, if
+// there is one.
+func (c *CheckInstance) saveState() {
+	if c.cfg == nil || c.cfg.store == nil {
+		return
+	}
+	c.RLock()
+	id := c.Check.Id
+	state := savedState{
+		Updated:     c.Check.Updated,
+		State:       c.State,
+		StateChange: c.StateChange,
+		LastError:   c.LastError,
+	}
+	c.RUnlock()
+	c.cfg.store.set(id, state)
+}
@@ -1,21 +1,25 @@
 package scheduler
 
 import (
+	"encoding/binary"
+	"hash/fnv"
 	"sync"
 	"time"
+
+	m "github.com/raintank/worldping-api/pkg/models"
 )
 
 type Ticker struct {
 	sync.Mutex
 	stopped  bool
 	interval int64
-	offset   int64
+	offset   time.Duration
 	timer    *time.Timer
 	C        chan time.Time
 	shutdown chan struct{}
 }
 
-func NewTicker(interval int64, offset int64) *Ticker {
+func NewTicker(interval int64, offset time.Duration) *Ticker {
 	t := &Ticker{
 		stopped:  true,
 		interval: interval,
@@ -40,7 +44,7 @@ func (t *Ticker) Ticks() {
 	}
 }
 
-func (t *Ticker) Update(interval int64, offset int64) {
+func (t *Ticker) Update(interval int64, offset time.Duration) {
 	t.Lock()
 	t.interval = interval
 	t.offset = offset
@@ -55,19 +59,21 @@ func (t *Ticker) next() {
 		t.Unlock()
 		return
 	}
-	// calculate the number of seconds until our next tick.
-	now := time.Now().Unix()
-	nextTick := ((t.interval + t.offset) - (now % t.interval)) % t.interval
+	// calculate the time until our next tick. Ticks are aligned to the
+	// interval, so they happen at the same time after a restart.
+	interval := time.Second * time.Duration(t.interval)
+	now := time.Duration(time.Now().UnixNano())
+	nextTick := ((interval + t.offset%interval) - (now % interval)) % interval
 	if nextTick == 0 {
-		nextTick = t.interval
+		nextTick = interval
 	}
 
-	// set the timer to fire in nextTicks seconds.
+	// set the timer to fire in nextTick.
 	if t.timer == nil {
-		t.timer = time.NewTimer(time.Second * time.Duration(nextTick))
+		t.timer = time.NewTimer(nextTick)
 		go t.Ticks()
 	} else {
-		t.timer.Reset(time.Second * time.Duration(nextTick))
+		t.timer.Reset(nextTick)
 	}
 	t.Unlock()
 }
@@ -92,3 +98,17 @@ func (t *Ticker) Delete() {
 	t.Stop()
 	close(t.shutdown)
 }
+
+// checkOffset returns how far into each interval the check runs. Checks
+// without an offset are spread across their frequency, with millisecond
+// resolution, when cfg.SpreadOffsets is set. The spread offset is derived from
+// the check id, so it is the same every time the check is scheduled.
+func checkOffset(c *m.CheckWithSlug, cfg *Config) time.Duration {
+	if c.Offset != 0 || cfg == nil || !cfg.SpreadOffsets || c.Frequency <= 0 {
+		return time.Second * time.Duration(c.Offset)
+	}
+	h := fnv.New64a()
+	binary.Write(h, binary.BigEndian, c.Id)
+	ms := h.Sum64() % uint64(c.Frequency*1000)
+	return time.Millisecond * time.Duration(ms)
+}
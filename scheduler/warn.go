@@ -0,0 +1,117 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/raintank/raintank-probe/checks"
+	m "github.com/raintank/worldping-api/pkg/models"
+)
+
+// result fields that warning thresholds can be set on, for each check type.
+var warnFields = map[m.CheckType][]string{
+	m.PING_CHECK:  {"loss", "min", "max", "avg", "median", "mdev"},
+	m.DNS_CHECK:   {"time", "ttl", "answers"},
+	m.HTTP_CHECK:  {"dns", "connect", "send", "wait", "recv", "total", "dataLength", "throughput", "statusCode"},
+	m.HTTPS_CHECK: {"dns", "connect", "send", "wait", "recv", "total", "dataLength", "throughput", "statusCode", "expiry"},
+}
+
+// result fields where a value below the threshold is a warning. For all
+// other fields a value above the threshold is a warning.
+var warnBelow = map[string]bool{
+	"expiry":     true,
+	"throughput": true,
+	"answers":    true,
+}
+
+// result fields reported in seconds, where the threshold is set in days.
+var warnDays = map[string]bool{
+	"expiry": true,
+}
+
+// warnThresholds are read from the optional "warnThresholds" check setting,
+// which maps result fields to the value at which the check is in a warning
+// state, eg. {"total": 2000, "expiry": 14}. expiry is set in days.
+type warnThresholds map[string]float64
+
+func getWarnThresholds(checkType m.CheckType, settings map[string]interface{}) (warnThresholds, error) {
+	raw, ok := settings["warnThresholds"]
+	if !ok {
+		return nil, nil
+	}
+	thresholds, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid value for warnThresholds, must be object.")
+	}
+	w := make(warnThresholds)
+	for field, value := range thresholds {
+		if !isWarnField(checkType, field) {
+			return nil, fmt.Errorf("invalid warnThresholds field %s for %s check. must be one of %s.", field, checkType, strings.Join(warnFields[checkType], ", "))
+		}
+		v, ok := value.(float64)
+		if !ok {
+			return nil, fmt.Errorf("invalid value for warnThresholds.%s, must be number.", field)
+		}
+		w[field] = v
+	}
+	return w, nil
+}
+
+func isWarnField(checkType m.CheckType, field string) bool {
+	for _, f := range warnFields[checkType] {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns a message describing the thresholds the result has crossed,
+// or an empty string if there are none. Fields that were not measured are
+// ignored.
+func (w warnThresholds) check(result checks.CheckResult) string {
+	if len(w) == 0 {
+		return ""
+	}
+	body, err := json.Marshal(result)
+	if err != nil {
+		return ""
+	}
+	values := make(map[string]interface{})
+	if err := json.Unmarshal(body, &values); err != nil {
+		return ""
+	}
+
+	var msgs []string
+	for field, threshold := range w {
+		value, ok := values[field].(float64)
+		if !ok {
+			continue
+		}
+		limit := threshold
+		unit := ""
+		if warnDays[field] {
+			limit = threshold * 24 * 60 * 60
+			unit = " days"
+		}
+		if warnBelow[field] && value < limit {
+			msgs = append(msgs, fmt.Sprintf("%s below warning threshold of %v%s", field, threshold, unit))
+		} else if !warnBelow[field] && value > limit {
+			msgs = append(msgs, fmt.Sprintf("%s above warning threshold of %v%s", field, threshold, unit))
+		}
+	}
+	sort.Strings(msgs)
+	return strings.Join(msgs, ", ")
+}
+
+// Warning returns a message describing the warning thresholds of the check
+// that the result has crossed, or an empty string if there are none.
+func Warning(check *m.CheckWithSlug, result checks.CheckResult) string {
+	w, err := getWarnThresholds(check.Type, check.Settings)
+	if err != nil {
+		return ""
+	}
+	return w.check(result)
+}
@@ -0,0 +1,263 @@
+package standalone
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raintank/raintank-probe/scheduler"
+	m "github.com/raintank/worldping-api/pkg/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// Config is the content of a local checks file, used to run the probe
+// without the worldping-api controller.
+//
+//	{
+//	  "probe": {"id": 1, "org_id": 1, "slug": "my-probe", "name": "my probe", "tags": ["office"], "latitude": 51.5, "longitude": -0.1},
+//	  "checks": [
+//	    {"id": 1, "orgId": 1, "endpointSlug": "example_com", "type": "http", "frequency": 60, "settings": {"host": "example.com", "path": "/"}}
+//	  ]
+//	}
+type Config struct {
+	Probe  *m.ProbeDTO
+	Checks []*m.CheckWithSlug
+}
+
+type fileConfig struct {
+	Probe  *m.ProbeDTO       `json:"probe"`
+	Checks []CheckDefinition `json:"checks"`
+}
+
+// CheckDefinition is the format of a check in the checks file.
+type CheckDefinition struct {
+	Id        int64                  `json:"id"`
+	OrgId     int64                  `json:"orgId"`
+	Slug      string                 `json:"endpointSlug"`
+	Type      m.CheckType            `json:"type"`
+	Frequency int64                  `json:"frequency"`
+	Offset    int64                  `json:"offset"`
+	Enabled   *bool                  `json:"enabled"`
+	Settings  map[string]interface{} `json:"settings"`
+}
+
+// Errors holds all of the problems found in a checks file.
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Load reads and validates the checks file at path. If defaultSlug is set it is
+// used when the file does not define a probe slug. No partial config is returned,
+// if any check is invalid an Errors listing every problem is returned. Only
+// JSON checks files are supported.
+func Load(path string, defaultSlug string) (*Config, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return nil, fmt.Errorf("%s is a YAML file. the checks file must be JSON", path)
+	}
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(body, defaultSlug)
+}
+
+// Parse decodes and validates the content of a checks file.
+func Parse(body []byte, defaultSlug string) (*Config, error) {
+	fc := fileConfig{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&fc); err != nil {
+		return nil, fmt.Errorf("unable to parse checks file. %s", err)
+	}
+
+	var errs Errors
+	cfg := &Config{
+		Probe:  fc.Probe,
+		Checks: make([]*m.CheckWithSlug, 0, len(fc.Checks)),
+	}
+	if cfg.Probe == nil {
+		cfg.Probe = &m.ProbeDTO{}
+	}
+	if cfg.Probe.Slug == "" {
+		cfg.Probe.Slug = defaultSlug
+	}
+	if cfg.Probe.Slug == "" {
+		errs = append(errs, fmt.Errorf("probe slug must be set"))
+	}
+	if cfg.Probe.Name == "" {
+		cfg.Probe.Name = cfg.Probe.Slug
+	}
+	if cfg.Probe.OrgId == 0 {
+		cfg.Probe.OrgId = 1
+	}
+	cfg.Probe.Online = true
+	cfg.Probe.Enabled = true
+
+	now := time.Now()
+	seen := make(map[int64]struct{})
+	for i, c := range fc.Checks {
+		check, err := c.ToCheck(cfg.Probe.OrgId, now)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("check %d (id=%d): %s", i, c.Id, err))
+			continue
+		}
+		if _, ok := seen[check.Id]; ok {
+			errs = append(errs, fmt.Errorf("check %d (id=%d): duplicate check id", i, c.Id))
+			continue
+		}
+		seen[check.Id] = struct{}{}
+		cfg.Checks = append(cfg.Checks, check)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return cfg, nil
+}
+
+// ToCheck validates the definition and converts it to the check passed to the scheduler.
+func (c CheckDefinition) ToCheck(defaultOrgId int64, updated time.Time) (*m.CheckWithSlug, error) {
+	if c.Id <= 0 {
+		return nil, fmt.Errorf("id must be greater than 0")
+	}
+	if c.Slug == "" {
+		return nil, fmt.Errorf("endpointSlug must be set")
+	}
+	if c.Frequency <= 0 {
+		return nil, fmt.Errorf("frequency must be greater than 0")
+	}
+	if c.Offset < 0 || c.Offset >= c.Frequency {
+		return nil, fmt.Errorf("offset must be between 0 and frequency")
+	}
+	if c.Settings == nil {
+		c.Settings = make(map[string]interface{})
+	}
+	if _, err := scheduler.GetCheck(c.Type, c.Settings); err != nil {
+		return nil, err
+	}
+	check := &m.CheckWithSlug{
+		Check: m.Check{
+			Id:        c.Id,
+			OrgId:     c.OrgId,
+			Type:      c.Type,
+			Frequency: c.Frequency,
+			Offset:    c.Offset,
+			Enabled:   true,
+			Settings:  c.Settings,
+			State:     m.EvalResultUnknown,
+			Created:   updated,
+			Updated:   updated,
+		},
+		Slug: c.Slug,
+	}
+	if check.OrgId == 0 {
+		check.OrgId = defaultOrgId
+	}
+	if c.Enabled != nil {
+		check.Enabled = *c.Enabled
+	}
+	return check, nil
+}
+
+// Source loads the checks file, tracking the definitions from the previous
+// successful load so that unchanged checks keep their Updated timestamp. This
+// allows the result to be passed to scheduler.Refresh without resetting the
+// CheckInstances of checks that have not changed.
+type Source struct {
+	sync.Mutex
+	Path        string
+	defaultSlug string
+	checks      map[int64]*m.CheckWithSlug
+	modTime     time.Time
+	size        int64
+}
+
+func NewSource(path string, defaultSlug string) *Source {
+	return &Source{
+		Path:        path,
+		defaultSlug: defaultSlug,
+		checks:      make(map[int64]*m.CheckWithSlug),
+	}
+}
+
+// Load reads the checks file. If the file is invalid an error is returned and
+// the previously loaded state is left untouched.
+func (s *Source) Load() (*Config, error) {
+	s.Lock()
+	defer s.Unlock()
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	// record the file version even if it is invalid, so Watch does not keep
+	// trying to load the same broken file.
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+	cfg, err := Load(s.Path, s.defaultSlug)
+	if err != nil {
+		return nil, err
+	}
+	checks := make(map[int64]*m.CheckWithSlug)
+	for _, c := range cfg.Checks {
+		if prev, ok := s.checks[c.Id]; ok && sameDefinition(prev, c) {
+			c.Created = prev.Created
+			c.Updated = prev.Updated
+		}
+		checks[c.Id] = c
+	}
+	s.checks = checks
+	return cfg, nil
+}
+
+// Changed returns true if the checks file has been modified since it was last loaded.
+func (s *Source) Changed() bool {
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		log.Debugf("unable to stat %s. %s", s.Path, err)
+		return false
+	}
+	s.Lock()
+	defer s.Unlock()
+	return !info.ModTime().Equal(s.modTime) || info.Size() != s.size
+}
+
+// Watch polls the checks file every interval and calls onChange when it has
+// been modified, until shutdown is closed.
+func (s *Source) Watch(interval time.Duration, shutdown chan struct{}, onChange func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-shutdown:
+			return
+		case <-ticker.C:
+			if s.Changed() {
+				log.Infof("%s has changed", s.Path)
+				onChange()
+			}
+		}
+	}
+}
+
+func sameDefinition(a, b *m.CheckWithSlug) bool {
+	return a.OrgId == b.OrgId &&
+		a.Slug == b.Slug &&
+		a.Type == b.Type &&
+		a.Frequency == b.Frequency &&
+		a.Offset == b.Offset &&
+		a.Enabled == b.Enabled &&
+		reflect.DeepEqual(a.Settings, b.Settings)
+}